@@ -11,7 +11,7 @@ import (
 // 暫存位置
 var DirPath string = ".tmp/"
 
-// Compress :
+// Compress : 將圖片尺寸減半，filename 為 Workspace 中的暫存檔路徑
 func Compress(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -1,23 +1,16 @@
 package cloudimage
 
 import (
-	"fmt"
 	"image/jpeg"
 	"os"
+	"path/filepath"
 
 	"github.com/nfnt/resize"
 )
 
 // compressJPG :
 func compressJPG(filename string) error {
-	newFilename := fmt.Sprintf("%st_%s", DirPath, filename)
-	filename = fmt.Sprintf("%s%s", DirPath, filename)
-
-	if err := os.Rename(filename, newFilename); err != nil {
-		return err
-	}
-
-	file, err := os.Open(newFilename)
+	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
@@ -31,18 +24,12 @@ func compressJPG(filename string) error {
 	// 尺寸減半
 	img = resize.Resize(uint(img.Bounds().Dx()/2), uint(img.Bounds().Dy()/2), img, resize.Lanczos3)
 
-	// 判断目录是否存在
-	if _, err := os.Stat(DirPath); os.IsNotExist(err) {
-		// 目录不存在，创建该目录
-		err = os.Mkdir(DirPath, 0755)
-		if err != nil {
-			return err
-		}
-	}
-	outfile, err := os.Create(filename)
+	// 先寫入同目錄下的新檔案，完成後再取代原檔
+	outfile, err := os.CreateTemp(filepath.Dir(filename), "*.jpg")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(outfile.Name())
 	defer outfile.Close()
 
 	options := &jpeg.Options{Quality: 90}
@@ -50,7 +37,8 @@ func compressJPG(filename string) error {
 	if err != nil {
 		return err
 	}
-
-	os.Remove(newFilename)
-	return nil
+	if err := outfile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(outfile.Name(), filename)
 }
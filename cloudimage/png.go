@@ -1,20 +1,15 @@
 package cloudimage
 
 import (
-	"fmt"
 	"image/png"
 	"os"
+	"path/filepath"
 
 	"github.com/nfnt/resize"
 )
 
 // compressPNG :
 func compressPNG(filename string) error {
-	newFilename := fmt.Sprintf("%st_%s", DirPath, filename)
-	if err := os.Rename(fmt.Sprintf("%s%s", DirPath, filename), newFilename); err != nil {
-		return err
-	}
-
 	infile, err := os.Open(filename)
 	if err != nil {
 		return err
@@ -29,18 +24,20 @@ func compressPNG(filename string) error {
 	// 尺寸減半
 	img = resize.Resize(uint(img.Bounds().Dx()/2), uint(img.Bounds().Dy()/2), img, resize.Lanczos3)
 
-	outfile, err := os.Create(fmt.Sprintf("%s%s", DirPath, filename))
+	// 先寫入同目錄下的新檔案，完成後再取代原檔
+	outfile, err := os.CreateTemp(filepath.Dir(filename), "*.png")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(outfile.Name())
 	defer outfile.Close()
 
-	// 儲存到指定路径
 	err = png.Encode(outfile, img)
 	if err != nil {
 		return err
 	}
-
-	os.Remove(newFilename)
-	return nil
+	if err := outfile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(outfile.Name(), filename)
 }
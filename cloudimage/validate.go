@@ -0,0 +1,61 @@
+package cloudimage
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+)
+
+// MaxPixels 允許的最大像素數 (寬 x 高)，避免解碼時耗盡記憶體
+var MaxPixels = 40_000_000
+
+// supportedTypes Compress 可處理的格式，key 為 image.DecodeConfig 回傳的名稱
+var supportedTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrInvalidImage      = errors.New("invalid image")
+	ErrTooManyPixels     = errors.New("image dimensions too large")
+)
+
+// Validate : 以檔案開頭的內容判斷格式，只讀取標頭確認尺寸，不解碼整張圖片。
+// 檢查後會回到檔案開頭，回傳格式名稱 (jpeg, png)
+func Validate(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", ErrInvalidImage
+	}
+	sniffed := http.DetectContentType(head[:n])
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return "", ErrUnsupportedFormat
+		}
+		return "", ErrInvalidImage
+	}
+	// 內容與宣告的格式需一致
+	if contentType, ok := supportedTypes[format]; !ok || contentType != sniffed {
+		return "", ErrUnsupportedFormat
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return "", ErrInvalidImage
+	}
+	if int64(config.Width)*int64(config.Height) > int64(MaxPixels) {
+		return "", fmt.Errorf("%w: %dx%d", ErrTooManyPixels, config.Width, config.Height)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return format, nil
+}
@@ -0,0 +1,91 @@
+package cloudimage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MaxTempBytes 所有暫存檔合計的上限，0 表示不限制
+var MaxTempBytes int64 = 1 << 30
+
+var ErrTempFull = errors.New("temporary storage is full")
+
+// tempUsage 目前所有 Workspace 預留的大小
+var (
+	tempMu    sync.Mutex
+	tempUsage int64
+)
+
+// Workspace : 單一請求使用的暫存目錄，Close 時刪除所有檔案並歸還預留的空間
+type Workspace struct {
+	dir string
+
+	mu       sync.Mutex
+	reserved int64
+}
+
+// NewWorkspace : 在 DirPath 之下建立名稱不重複的暫存目錄
+func NewWorkspace() (*Workspace, error) {
+	if err := os.MkdirAll(DirPath, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(DirPath, "req-")
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{dir: dir}, nil
+}
+
+// Reserve : 寫入之前預留空間，超過 MaxTempBytes 時回傳 ErrTempFull
+func (ws *Workspace) Reserve(n int64) error {
+	tempMu.Lock()
+	defer tempMu.Unlock()
+	if MaxTempBytes > 0 && tempUsage+n > MaxTempBytes {
+		return ErrTempFull
+	}
+	tempUsage += n
+
+	ws.mu.Lock()
+	ws.reserved += n
+	ws.mu.Unlock()
+	return nil
+}
+
+// Create : 建立名稱不重複的暫存檔，保留 name 的副檔名
+func (ws *Workspace) Create(name string) (*os.File, error) {
+	return os.CreateTemp(ws.dir, "*"+filepath.Ext(name))
+}
+
+// Close : 刪除暫存目錄，可重複呼叫
+func (ws *Workspace) Close() error {
+	ws.mu.Lock()
+	reserved := ws.reserved
+	ws.reserved = 0
+	ws.mu.Unlock()
+
+	tempMu.Lock()
+	tempUsage -= reserved
+	tempMu.Unlock()
+	return os.RemoveAll(ws.dir)
+}
+
+// CleanTemp : 刪除 DirPath 中上次執行留下的暫存檔，需在開始處理請求之前執行
+func CleanTemp() (int, error) {
+	entries, err := os.ReadDir(DirPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(DirPath, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,95 @@
+package cloudkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyPrefix 個人 API Key 的前綴，用來與 JWT 區分
+const APIKeyPrefix = "i2c_"
+
+// apiKeyHintLen 列表顯示用的前幾個字元
+const apiKeyHintLen = len(APIKeyPrefix) + 6
+
+var ErrInvalidAPIKey = errors.New("invalid or expired api key")
+
+// APIKeyResolver : 以 API Key 的雜湊值查出對應的使用者身分，
+// 找不到、已撤銷或已過期時回傳 ErrInvalidAPIKey
+type APIKeyResolver interface {
+	ResolveAPIKey(ctx context.Context, hash string) (*Principal, error)
+}
+
+var (
+	apiKeyMu       sync.RWMutex
+	apiKeyResolver APIKeyResolver
+)
+
+// SetAPIKeyResolver : 設定 Auth 使用的 API Key 查詢，未設定時只接受 JWT
+func SetAPIKeyResolver(r APIKeyResolver) {
+	apiKeyMu.Lock()
+	apiKeyResolver = r
+	apiKeyMu.Unlock()
+}
+
+// IsAPIKey :
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// NewAPIKey : 產生 API Key、要存入 DB 的雜湊值與列表顯示用的提示
+func NewAPIKey() (key, hash, hint string, err error) {
+	secret, err := RandomToken(32)
+	if err != nil {
+		return "", "", "", err
+	}
+	key = APIKeyPrefix + secret
+	return key, HashToken(key), key[:apiKeyHintLen], nil
+}
+
+// ParseScopes : 檢查權限範圍是否合法，並去除重複
+func ParseScopes(scopes []string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+	for _, s := range scopes {
+		switch s {
+		case ScopeRead, ScopeUpload, ScopeDelete:
+		default:
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return out, nil
+}
+
+// principalFromAPIKey :
+func principalFromAPIKey(ctx context.Context, key string) (*Principal, error) {
+	apiKeyMu.RLock()
+	resolver := apiKeyResolver
+	apiKeyMu.RUnlock()
+	if resolver == nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	p, err := resolver.ResolveAPIKey(ctx, HashToken(key))
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("resolve api key: %v", err)
+		return nil, errors.New("unable to check api key")
+	}
+	return p, nil
+}
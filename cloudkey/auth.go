@@ -1,47 +1,128 @@
 package cloudkey
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
-var sampleSecretKey = []byte("SecretYouShouldHide")
+// TokenTTL Access Token 有效期限，過期後以 Refresh Token 換發
+const TokenTTL = 15 * time.Minute
 
-// CreateToken :
-func CreateToken(uid int, account, username string) (string, error) {
-	now := time.Now()
-	// 加上 24 小時
-	future := now.Add(24 * time.Hour)
-	// 將時間轉換為 Unix 時間戳記
-	timestamp := future.Unix()
+// 特定用途的 Token
+const (
+	PurposeMFA    = "mfa"    // 密碼驗證後等待輸入 TOTP 驗證碼
+	PurposeVerify = "verify" // Email 驗證連結
+)
+
+// MFATokenTTL 密碼驗證後等待輸入 TOTP 驗證碼的期限
+const MFATokenTTL = 5 * time.Minute
+
+// VerifyTokenTTL Email 驗證連結有效期限
+const VerifyTokenTTL = 24 * time.Hour
+
+// KeyRetention 以簽章金鑰簽發的 Token 中最長的有效期限 (Access Token、MFA、Email 驗證、OIDC state)，
+// 金鑰輪替後舊金鑰至少需保留此時間。新增用途時需確認不超過此值
+const KeyRetention = VerifyTokenTTL
+
+// CreateToken : 依角色決定 Access Token 的權限範圍
+func CreateToken(uid int, account, username, role string) (string, error) {
+	if !ValidRole(role) {
+		return "", fmt.Errorf("unknown role %q", role)
+	}
+	claims, err := newClaims(uid, account, username, RoleScopes(role), TokenTTL)
+	if err != nil {
+		return "", err
+	}
+	claims.Role = role
+	return signClaims(claims)
+}
+
+// signClaims : 以目前的 active 金鑰簽章
+func signClaims(claims jwt.Claims) (string, error) {
+	key, err := activeKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"uid":      uid,
-		"account":  account,
-		"username": username,
-		"exp":      timestamp,
-	})
+	return token.SignedString(key.signKey)
+}
+
+// keyFunc : 依 kid 取得驗證金鑰
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("missing kid header")
+	}
+	key, err := verificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
 
-	return token.SignedString(sampleSecretKey)
+	// Don't forget to validate the alg is what you expect:
+	if token.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
 }
 
-// ValidateToken :
-func ValidateToken(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// parseClaims : 驗證簽章並解析 claims，回傳 jwt 內部的原始錯誤
+func parseClaims(tokenString string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	if err != nil {
+		var ve *jwt.ValidationError
+		if errors.As(err, &ve) && ve.Inner != nil {
+			return ve.Inner
 		}
+		return err
+	}
+	if !token.Valid {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// CreatePurposeToken : 簽發特定用途的短期 Token，不能當作 Access Token 使用
+func CreatePurposeToken(uid int, account, username, purpose string, ttl time.Duration) (string, error) {
+	claims, err := newClaims(uid, account, username, nil, ttl)
+	if err != nil {
+		return "", err
+	}
+	claims.Purpose = purpose
+	return signClaims(claims)
+}
 
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return sampleSecretKey, nil
-	})
+// CreateMFAToken : 密碼驗證通過但尚未輸入 TOTP 驗證碼時使用的短期 Token，
+// 只能用於 /api/login/mfa 換取 Access Token
+func CreateMFAToken(uid int, account, username string) (string, error) {
+	return CreatePurposeToken(uid, account, username, PurposeMFA, MFATokenTTL)
+}
+
+// ValidateToken : 驗證 Access Token
+func ValidateToken(tokenString string) (*Claims, error) {
+	return ValidatePurposeToken(tokenString, "")
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return jwt.MapClaims{}, err
+// ValidateMFAToken : 驗證 CreateMFAToken 簽發的 Token
+func ValidateMFAToken(tokenString string) (*Claims, error) {
+	return ValidatePurposeToken(tokenString, PurposeMFA)
+}
+
+// ValidatePurposeToken : 驗證 Token 並確認用途
+func ValidatePurposeToken(tokenString, purpose string) (*Claims, error) {
+	claims := &Claims{}
+	if err := parseClaims(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("unexpected token purpose %q", claims.Purpose)
+	}
+	if err := checkRevoked(claims.Id); err != nil {
+		return nil, err
 	}
+	return claims, nil
 }
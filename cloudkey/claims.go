@@ -0,0 +1,133 @@
+package cloudkey
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	ErrTokenExpired     = errors.New("token is expired")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrTokenUsedBefore  = errors.New("token used before issued")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+	ErrMissingClaim     = errors.New("missing required claim")
+)
+
+// Claims : image2cloud Access Token 內容
+type Claims struct {
+	UID      int    `json:"uid"`
+	Account  string `json:"account"`
+	Username string `json:"username"`
+	Scope    string `json:"scope,omitempty"`
+	Role     string `json:"role,omitempty"`
+	// Purpose 非空時為特定用途的 Token (例如 MFA 驗證)，不能當作 Access Token
+	Purpose string `json:"pur,omitempty"`
+	jwt.StandardClaims
+}
+
+// Scopes :
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// ExpiresTime :
+func (c *Claims) ExpiresTime() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// validation 驗證 Token 時的設定
+type validation struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+var (
+	validationMu sync.RWMutex
+	validator    = validation{issuer: "image2cloud", audience: "image2cloud", leeway: 30 * time.Second}
+)
+
+// SetValidation : 設定簽發與驗證 Token 的 iss、aud 以及時間容許誤差，
+// 不同環境應使用不同的 iss/aud，避免 Token 在環境間通用
+func SetValidation(issuer, audience string, leeway time.Duration) {
+	validationMu.Lock()
+	validator = validation{issuer: issuer, audience: audience, leeway: leeway}
+	validationMu.Unlock()
+}
+
+// currentValidation :
+func currentValidation() validation {
+	validationMu.RLock()
+	defer validationMu.RUnlock()
+	return validator
+}
+
+// Valid : 由 jwt.ParseWithClaims 呼叫，嚴格檢查必要欄位、iss、aud 與時間
+func (c *Claims) Valid() error {
+	v := currentValidation()
+	now := time.Now()
+
+	switch {
+	case c.Subject == "":
+		return fmt.Errorf("%w: sub", ErrMissingClaim)
+	case c.Account == "":
+		return fmt.Errorf("%w: account", ErrMissingClaim)
+	case c.Id == "":
+		return fmt.Errorf("%w: jti", ErrMissingClaim)
+	case c.ExpiresAt == 0:
+		return fmt.Errorf("%w: exp", ErrMissingClaim)
+	case c.IssuedAt == 0:
+		return fmt.Errorf("%w: iat", ErrMissingClaim)
+	}
+	if c.Subject != strconv.Itoa(c.UID) {
+		return fmt.Errorf("sub %q does not match uid %d", c.Subject, c.UID)
+	}
+	if c.Issuer != v.issuer {
+		return fmt.Errorf("%w: %q", ErrInvalidIssuer, c.Issuer)
+	}
+	if c.Audience != v.audience {
+		return fmt.Errorf("%w: %q", ErrInvalidAudience, c.Audience)
+	}
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(v.leeway)) {
+		return ErrTokenExpired
+	}
+	if now.Add(v.leeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return ErrTokenUsedBefore
+	}
+	if c.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrTokenNotYetValid
+	}
+	return nil
+}
+
+// newClaims :
+func newClaims(uid int, account, username string, scopes []string, ttl time.Duration) (*Claims, error) {
+	jti, err := RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	v := currentValidation()
+	now := time.Now()
+	return &Claims{
+		UID:      uid,
+		Account:  account,
+		Username: username,
+		Scope:    strings.Join(scopes, " "),
+		StandardClaims: jwt.StandardClaims{
+			Subject:   strconv.Itoa(uid),
+			Issuer:    v.issuer,
+			Audience:  v.audience,
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}, nil
+}
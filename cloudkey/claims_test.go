@@ -0,0 +1,134 @@
+package cloudkey
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// setTestKeys : 設定 HS256 (active) 與 ES256 兩把測試金鑰
+func setTestKeys(t *testing.T) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &KeySet{
+		Active: "hs",
+		Keys: []SigningKey{
+			{ID: "hs", Alg: AlgHS256, Secret: []byte(strings.Repeat("s", 32))},
+			{ID: "es", Alg: AlgES256, PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))},
+		},
+	}
+	if err := SetKeySet(context.Background(), ks); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimsValid(t *testing.T) {
+	SetValidation("image2cloud", "image2cloud", 30*time.Second)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		modify func(c *Claims)
+		want   error
+	}{
+		{name: "valid", modify: func(c *Claims) {}},
+		{name: "issuer mismatch", modify: func(c *Claims) { c.Issuer = "other" }, want: ErrInvalidIssuer},
+		{name: "audience mismatch", modify: func(c *Claims) { c.Audience = "other" }, want: ErrInvalidAudience},
+		{name: "missing subject", modify: func(c *Claims) { c.Subject = "" }, want: ErrMissingClaim},
+		{name: "missing jti", modify: func(c *Claims) { c.Id = "" }, want: ErrMissingClaim},
+		{name: "nbf within leeway", modify: func(c *Claims) { c.NotBefore = now.Add(10 * time.Second).Unix() }},
+		{name: "nbf in the future", modify: func(c *Claims) { c.NotBefore = now.Add(time.Minute).Unix() }, want: ErrTokenNotYetValid},
+		{name: "iat in the future", modify: func(c *Claims) { c.IssuedAt = now.Add(time.Minute).Unix() }, want: ErrTokenUsedBefore},
+		{name: "expired within leeway", modify: func(c *Claims) { c.ExpiresAt = now.Add(-10 * time.Second).Unix() }},
+		{name: "expired outside leeway", modify: func(c *Claims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }, want: ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newClaims(7, "alice", "Alice", nil, TokenTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(c)
+			err = c.Valid()
+			if tt.want == nil && err != nil {
+				t.Fatalf("Valid() = %v, want nil", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("Valid() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	c, err := newClaims(7, "alice", "Alice", nil, TokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UID = 8
+	if err := c.Valid(); err == nil {
+		t.Error("Valid() with sub not matching uid = nil, want error")
+	}
+}
+
+func TestValidateTokenKeyFunc(t *testing.T) {
+	SetValidation("image2cloud", "image2cloud", 30*time.Second)
+	setTestKeys(t)
+
+	token, err := CreateToken(7, "alice", "Alice", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(token); err != nil {
+		t.Fatalf("ValidateToken() = %v", err)
+	}
+
+	claims, err := newClaims(7, "alice", "Alice", nil, TokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(kid string, method jwt.SigningMethod, key interface{}) string {
+		tok := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			tok.Header["kid"] = kid
+		}
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	secret := []byte(strings.Repeat("s", 32))
+	tests := map[string]string{
+		"missing kid": sign("", jwt.SigningMethodHS256, secret),
+		"unknown kid": sign("nope", jwt.SigningMethodHS256, secret),
+		// 以 HS256 簽章卻宣稱是 ES256 金鑰，不能以對稱方式驗證
+		"alg mismatch": sign("es", jwt.SigningMethodHS256, secret),
+		"wrong secret": sign("hs", jwt.SigningMethodHS256, []byte(strings.Repeat("x", 32))),
+	}
+	for name, s := range tests {
+		if _, err := ValidateToken(s); err == nil {
+			t.Errorf("%s: ValidateToken() = nil, want error", name)
+		}
+	}
+
+	// 其他環境的 Token 不能通用
+	SetValidation("image2cloud-staging", "image2cloud-staging", 30*time.Second)
+	defer SetValidation("image2cloud", "image2cloud", 30*time.Second)
+	if _, err := ValidateToken(token); !errors.Is(err, ErrInvalidIssuer) {
+		t.Errorf("ValidateToken() from another issuer = %v, want %v", err, ErrInvalidIssuer)
+	}
+}
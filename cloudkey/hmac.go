@@ -2,49 +2,169 @@ package cloudkey
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
+	"os"
+	"strings"
+	"sync"
 
-	kms "cloud.google.com/go/kms/apiv1"
 	"cloud.google.com/go/kms/apiv1/kmspb"
 )
 
+// MacSigner : 產生密碼的 MAC，支援多個金鑰版本以便輪替
+type MacSigner interface {
+	// PrimaryVersion : 產生新雜湊使用的金鑰版本
+	PrimaryVersion() string
+	SignMac(ctx context.Context, version string, data []byte) ([]byte, error)
+}
+
 var (
-	fullKeyName string
+	macMu          sync.RWMutex
+	macSigner      MacSigner
+	macLegacy      string
+	errNoMacSigner = errors.New("mac signer not configured")
 )
 
-// signMac will sign a plaintext message using the HMAC algorithm.
-func SignMac(w io.Writer, data string) (string, error) {
-	// Create the client.
-	ctx := context.Background()
-	client, err := kms.NewKeyManagementClient(ctx)
+// SetMacSigner : 設定 SignMac 使用的 MacSigner。legacyVersion 為尚未記錄
+// 金鑰版本的舊資料所使用的版本，空字串表示與 PrimaryVersion 相同
+func SetMacSigner(s MacSigner, legacyVersion string) {
+	macMu.Lock()
+	macSigner = s
+	macLegacy = legacyVersion
+	macMu.Unlock()
+}
+
+// MacVersion : 目前產生新 MAC 的金鑰版本
+func MacVersion() (string, error) {
+	macMu.RLock()
+	defer macMu.RUnlock()
+	if macSigner == nil {
+		return "", errNoMacSigner
+	}
+	return macSigner.PrimaryVersion(), nil
+}
+
+// SignMac will sign a plaintext message using the HMAC algorithm.
+// version 為空字串時使用舊資料的金鑰版本
+func SignMac(version, data string) (string, error) {
+	macMu.RLock()
+	s, legacy := macSigner, macLegacy
+	macMu.RUnlock()
+	if s == nil {
+		return "", errNoMacSigner
+	}
+	if version == "" {
+		version = legacy
+	}
+	if version == "" {
+		version = s.PrimaryVersion()
+	}
+
+	mac, err := s.SignMac(context.Background(), version, []byte(data))
 	if err != nil {
-		return "", fmt.Errorf("failed to create kms client: %v", err)
+		return "", err
+	}
+
+	// The data comes back as raw bytes, which may include non-printable
+	// characters. This base64-encodes the result so it can be stored.
+	return base64.StdEncoding.EncodeToString(mac), nil
+}
+
+// KMSMacSigner : 以 Cloud KMS HMAC 金鑰簽章
+type KMSMacSigner struct {
+	keyName string
+	primary string
+}
+
+// NewKMSMacSigner : 設定 KMS HAMC Key Name，key_version 為產生新 MAC 的版本
+func NewKMSMacSigner(project_id, key_ring, key_name, key_version string) *KMSMacSigner {
+	return &KMSMacSigner{
+		keyName: fmt.Sprintf("projects/%s/locations/global/keyRings/%s/cryptoKeys/%s", project_id, key_ring, key_name),
+		primary: key_version,
+	}
+}
+
+// PrimaryVersion :
+func (s *KMSMacSigner) PrimaryVersion() string {
+	return s.primary
+}
+
+// SignMac :
+func (s *KMSMacSigner) SignMac(ctx context.Context, version string, data []byte) ([]byte, error) {
+	client, err := kmsClient()
+	if err != nil {
+		return nil, err
 	}
-	defer client.Close()
 
 	// Build the request.
 	req := &kmspb.MacSignRequest{
-		Name: fullKeyName,
-		Data: []byte(data),
+		Name: fmt.Sprintf("%s/cryptoKeyVersions/%s", s.keyName, version),
+		Data: data,
 	}
 
 	// Generate HMAC of data.
 	result, err := client.MacSign(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to hmac sign: %v", err)
+		return nil, fmt.Errorf("failed to hmac sign: %v", err)
 	}
+	return result.Mac, nil
+}
 
-	// The data comes back as raw bytes, which may include non-printable
-	// characters. This base64-encodes the result so it can be printed below.
-	encodedSignature := base64.StdEncoding.EncodeToString(result.Mac)
+// LocalMacSigner : 以本機金鑰計算 HMAC-SHA256，供開發與測試使用，
+// 不需連線 Cloud KMS
+type LocalMacSigner struct {
+	keys    map[string][]byte
+	primary string
+}
 
-	// fmt.Fprintf(w, "Signature: %s", encodedSignature)
-	return encodedSignature, nil
+// NewLocalMacSigner : 從檔案讀取金鑰，每行格式為 <version>:<base64 金鑰>，
+// 只有一行且沒有版本時視為版本 "1"
+func NewLocalMacSigner(path, primary string) (*LocalMacSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read mac key: %v", err)
+	}
+
+	s := &LocalMacSigner{keys: make(map[string][]byte), primary: primary}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		version, encoded, ok := strings.Cut(line, ":")
+		if !ok {
+			version, encoded = "1", line
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode mac key %q: %v", version, err)
+		}
+		if len(key) < 32 {
+			return nil, fmt.Errorf("mac key %q must be at least 32 bytes", version)
+		}
+		s.keys[version] = key
+	}
+	if _, ok := s.keys[primary]; !ok {
+		return nil, fmt.Errorf("mac key version %q not found", primary)
+	}
+	return s, nil
+}
+
+// PrimaryVersion :
+func (s *LocalMacSigner) PrimaryVersion() string {
+	return s.primary
 }
 
-// 設定 KMS HAMC Key Name
-func SetHMAC(project_id, key_ring, key_name, key_version string) {
-	fullKeyName = fmt.Sprintf("projects/%s/locations/global/keyRings/%s/cryptoKeys/%s/cryptoKeyVersions/%s", project_id, key_ring, key_name, key_version)
+// SignMac :
+func (s *LocalMacSigner) SignMac(ctx context.Context, version string, data []byte) ([]byte, error) {
+	key, ok := s.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown mac key version %q", version)
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil), nil
 }
@@ -0,0 +1,316 @@
+package cloudkey
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/golang-jwt/jwt"
+)
+
+// 支援的簽章演算法
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+var (
+	kmsMu        sync.Mutex
+	sharedClient *kms.KeyManagementClient
+)
+
+// kmsClient : 共用的 KMS client，建立失敗時下次呼叫會重試。
+// client 在整個程序中共用，不使用單一請求的 context 建立
+func kmsClient() (*kms.KeyManagementClient, error) {
+	kmsMu.Lock()
+	defer kmsMu.Unlock()
+	if sharedClient != nil {
+		return sharedClient, nil
+	}
+	client, err := kms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kms client: %v", err)
+	}
+	sharedClient = client
+	return sharedClient, nil
+}
+
+// kmsKey : 私鑰保存在 Cloud KMS 的簽章金鑰
+type kmsKey struct {
+	name string
+}
+
+// kmsSigningMethod 以 KMS AsymmetricSign 簽章，驗證則使用一般 RS256/ES256
+type kmsSigningMethod struct {
+	alg string
+}
+
+var (
+	kmsRS256 = &kmsSigningMethod{alg: AlgRS256}
+	kmsES256 = &kmsSigningMethod{alg: AlgES256}
+)
+
+func (m *kmsSigningMethod) Alg() string {
+	return m.alg
+}
+
+func (m *kmsSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	return jwt.GetSigningMethod(m.alg).Verify(signingString, signature, key)
+}
+
+func (m *kmsSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(*kmsKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := kmsClient()
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	result, err := client.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{
+		Name: k.name,
+		Digest: &kmspb.Digest{
+			Digest: &kmspb.Digest_Sha256{Sha256: digest[:]},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to asymmetric sign: %v", err)
+	}
+
+	sig := result.Signature
+	if m.alg == AlgES256 {
+		// KMS 回傳 DER 格式，JWS 需要 r||s 各 32 bytes
+		if sig, err = derToJOSE(sig, 32); err != nil {
+			return "", err
+		}
+	}
+	return jwt.EncodeSegment(sig), nil
+}
+
+// derToJOSE :
+func derToJOSE(der []byte, size int) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("parse ecdsa signature: %v", err)
+	}
+	out := make([]byte, 2*size)
+	sig.R.FillBytes(out[:size])
+	sig.S.FillBytes(out[size:])
+	return out, nil
+}
+
+// prepare : 依設定解析簽章與驗證用的金鑰
+func (k *SigningKey) prepare(ctx context.Context) error {
+	if k.Alg == "" {
+		k.Alg = AlgHS256
+	}
+	switch k.Alg {
+	case AlgHS256:
+		if len(k.Secret) < 32 {
+			return fmt.Errorf("key %q: secret must be at least 32 bytes", k.ID)
+		}
+		k.method = jwt.SigningMethodHS256
+		k.signKey = k.Secret
+		k.verifyKey = k.Secret
+		return nil
+	case AlgRS256, AlgES256:
+	default:
+		return fmt.Errorf("key %q: unsupported alg %q", k.ID, k.Alg)
+	}
+
+	switch {
+	case k.KMSKey != "":
+		pub, err := kmsPublicKey(ctx, k.KMSKey, k.Alg)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		k.method = kmsRS256
+		if k.Alg == AlgES256 {
+			k.method = kmsES256
+		}
+		k.signKey = &kmsKey{name: k.KMSKey}
+		k.verifyKey = pub
+	case k.PrivateKey != "":
+		priv, err := parsePrivateKey(k.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("key %q: unsupported private key", k.ID)
+		}
+		if err := checkKeyType(signer.Public(), k.Alg); err != nil {
+			return fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		k.method = jwt.GetSigningMethod(k.Alg)
+		k.signKey = priv
+		k.verifyKey = signer.Public()
+	case k.PublicKey != "":
+		// 只有公鑰: 僅能驗證，不能作為 active
+		pub, err := parsePublicKey(k.PublicKey)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		if err := checkKeyType(pub, k.Alg); err != nil {
+			return fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		k.method = jwt.GetSigningMethod(k.Alg)
+		k.verifyKey = pub
+	default:
+		return fmt.Errorf("key %q: one of kmsKey, privateKey or publicKey is required", k.ID)
+	}
+	return nil
+}
+
+// kmsPublicKey : 取得 KMS 金鑰版本的公鑰
+func kmsPublicKey(ctx context.Context, name, alg string) (crypto.PublicKey, error) {
+	client, err := kmsClient()
+	if err != nil {
+		return nil, err
+	}
+	result, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %v", err)
+	}
+	switch result.Algorithm {
+	case kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256,
+		kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_3072_SHA256,
+		kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA256:
+		if alg != AlgRS256 {
+			return nil, fmt.Errorf("kms algorithm %v does not match %s", result.Algorithm, alg)
+		}
+	case kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:
+		if alg != AlgES256 {
+			return nil, fmt.Errorf("kms algorithm %v does not match %s", result.Algorithm, alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported kms algorithm %v", result.Algorithm)
+	}
+	return parsePublicKey(result.Pem)
+}
+
+// parsePrivateKey : 解析 PEM 私鑰 (PKCS#1、PKCS#8 或 SEC 1)
+func parsePrivateKey(data string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid private key pem")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+// parsePublicKey : 解析 PEM 公鑰
+func parsePublicKey(data string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid public key pem")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// checkKeyType :
+func checkKeyType(pub crypto.PublicKey, alg string) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if alg == AlgRS256 {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == AlgES256 && key.Curve == elliptic.P256() {
+			return nil
+		}
+	}
+	return fmt.Errorf("key type %T does not match %s", pub, alg)
+}
+
+// JWK : JSON Web Key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS : JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKeys : 目前所有非對稱金鑰的公鑰，HMAC 金鑰不會公開
+func PublicKeys() JWKS {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	if keySet == nil {
+		return set
+	}
+	enc := base64.RawURLEncoding
+	for _, k := range keySet.Keys {
+		switch pub := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA", Kid: k.ID, Use: "sig", Alg: k.Alg,
+				N: enc.EncodeToString(pub.N.Bytes()),
+				E: enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			pub.X.FillBytes(x)
+			pub.Y.FillBytes(y)
+			set.Keys = append(set.Keys, JWK{
+				Kty: "EC", Kid: k.ID, Use: "sig", Alg: k.Alg, Crv: "P-256",
+				X: enc.EncodeToString(x),
+				Y: enc.EncodeToString(y),
+			})
+		}
+	}
+	return set
+}
+
+// JWKSHandler : 提供 /.well-known/jwks.json
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(PublicKeys())
+}
@@ -0,0 +1,204 @@
+package cloudkey
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy : 登入失敗的延遲與鎖定規則。
+// 失敗次數超過 FreeAttempts 後，每次失敗需等待 BaseDelay * 2^(n-FreeAttempts-1)，
+// 達到 MaxAttempts 時鎖定 Lockout；Window 內沒有新的失敗則重新計算
+type LockoutPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxAttempts  int
+	Lockout      time.Duration
+	Window       time.Duration
+}
+
+// 預設規則: IP 可能為多人共用，門檻較帳號寬鬆
+var (
+	DefaultAccountPolicy = LockoutPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxAttempts: 10, Lockout: 15 * time.Minute, Window: time.Hour}
+	DefaultIPPolicy      = LockoutPolicy{FreeAttempts: 10, BaseDelay: time.Second, MaxAttempts: 50, Lockout: 15 * time.Minute, Window: time.Hour}
+)
+
+// delay : 第 n 次失敗後需等待的時間
+func (p LockoutPolicy) delay(n int) time.Duration {
+	if n >= p.MaxAttempts {
+		return p.Lockout
+	}
+	if n <= p.FreeAttempts {
+		return 0
+	}
+	d := p.BaseDelay << uint(n-p.FreeAttempts-1)
+	if d <= 0 || d > p.Lockout {
+		return p.Lockout
+	}
+	return d
+}
+
+// Attempt : 某個 key 的登入失敗狀態
+type Attempt struct {
+	Failures    int
+	LockedUntil time.Time
+}
+
+// AttemptStore : 保存登入失敗狀態，多個執行個體需共用同一份資料
+type AttemptStore interface {
+	Get(ctx context.Context, key string) (Attempt, error)
+	// Increment : 增加失敗次數並回傳新的次數，上次失敗早於 window 時從 1 重新計算
+	Increment(ctx context.Context, key string, window time.Duration) (int, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// AccountKey :
+func AccountKey(account string) string {
+	return "account:" + strings.ToLower(account)
+}
+
+// IPKey :
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LoginLimiter : 以帳號與 IP 追蹤登入失敗次數
+type LoginLimiter struct {
+	store   AttemptStore
+	account LockoutPolicy
+	ip      LockoutPolicy
+}
+
+// NewLoginLimiter :
+func NewLoginLimiter(store AttemptStore, account, ip LockoutPolicy) *LoginLimiter {
+	return &LoginLimiter{store: store, account: account, ip: ip}
+}
+
+// policy :
+func (l *LoginLimiter) policy(key string) LockoutPolicy {
+	if strings.HasPrefix(key, "ip:") {
+		return l.ip
+	}
+	return l.account
+}
+
+// Check : 回傳需要等待的時間，0 表示可以嘗試登入
+func (l *LoginLimiter) Check(ctx context.Context, keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		a, err := l.store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if d := a.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Failure : 記錄一次登入失敗並回傳需要等待的時間
+func (l *LoginLimiter) Failure(ctx context.Context, keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range keys {
+		p := l.policy(key)
+		n, err := l.store.Increment(ctx, key, p.Window)
+		if err != nil {
+			return 0, err
+		}
+		d := p.delay(n)
+		if d == 0 {
+			continue
+		}
+		if err := l.store.Lock(ctx, key, time.Now().Add(d)); err != nil {
+			return 0, err
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Success : 登入成功後清除帳號的失敗紀錄 (IP 紀錄不清除，避免以自己的帳號重置)
+func (l *LoginLimiter) Success(ctx context.Context, account string) error {
+	return l.store.Reset(ctx, AccountKey(account))
+}
+
+// Unlock : 管理者解除鎖定
+func (l *LoginLimiter) Unlock(ctx context.Context, key string) error {
+	return l.store.Reset(ctx, key)
+}
+
+// MemoryAttemptStore : 單一執行個體使用的 AttemptStore
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*memoryAttempt
+}
+
+type memoryAttempt struct {
+	Attempt
+	lastFailure time.Time
+}
+
+// NewMemoryAttemptStore :
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]*memoryAttempt)}
+}
+
+// Get :
+func (s *MemoryAttemptStore) Get(ctx context.Context, key string) (Attempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.attempts[key]; ok {
+		return a.Attempt, nil
+	}
+	return Attempt{}, nil
+}
+
+// Increment :
+func (s *MemoryAttemptStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	a, ok := s.attempts[key]
+	if !ok {
+		a = &memoryAttempt{}
+		s.attempts[key] = a
+	}
+	if now.Sub(a.lastFailure) > window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.lastFailure = now
+
+	// 順便清除已過期的紀錄
+	for k, v := range s.attempts {
+		if now.Sub(v.lastFailure) > window && now.After(v.LockedUntil) {
+			delete(s.attempts, k)
+		}
+	}
+	return a.Failures, nil
+}
+
+// Lock :
+func (s *MemoryAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.attempts[key]; ok {
+		a.LockedUntil = until
+	}
+	return nil
+}
+
+// Reset :
+func (s *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.attempts, key)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,66 @@
+package cloudkey
+
+import (
+	"context"
+	"time"
+)
+
+// MailPolicy : 寄信限制，每 Per 最多寄出 Messages 封 (token bucket)，0 表示不限制
+type MailPolicy struct {
+	Messages int
+	Per      time.Duration
+}
+
+// 預設規則: IP 可能為多人共用，門檻較帳號寬鬆
+var (
+	DefaultAccountMailPolicy = MailPolicy{Messages: 3, Per: time.Hour}
+	DefaultIPMailPolicy      = MailPolicy{Messages: 20, Per: time.Hour}
+)
+
+// MailAccountKey :
+func MailAccountKey(account string) string {
+	return "mail:" + AccountKey(account)
+}
+
+// MailIPKey :
+func MailIPKey(ip string) string {
+	return "mail:" + IPKey(ip)
+}
+
+// MailLimiter : 依帳號與 IP 限制不需登入即可寄出的郵件 (重寄驗證信、忘記密碼)，
+// 不論帳號是否存在都會扣除，避免被用來查詢帳號
+type MailLimiter struct {
+	store   BucketStore
+	account MailPolicy
+	ip      MailPolicy
+}
+
+// NewMailLimiter :
+func NewMailLimiter(store BucketStore, account, ip MailPolicy) *MailLimiter {
+	return &MailLimiter{store: store, account: account, ip: ip}
+}
+
+// Allow : 帳號與 IP 都還有額度時才扣除，被拒絕時 Reason 為 "mail"
+func (l *MailLimiter) Allow(ctx context.Context, account, ip string) (RateDecision, error) {
+	var reqs []BucketRequest
+	if p := l.account; p.Messages > 0 {
+		reqs = append(reqs, BucketRequest{Key: MailAccountKey(account), Capacity: float64(p.Messages), Per: p.Per, N: 1})
+	}
+	if p := l.ip; p.Messages > 0 {
+		reqs = append(reqs, BucketRequest{Key: MailIPKey(ip), Capacity: float64(p.Messages), Per: p.Per, N: 1})
+	}
+	if len(reqs) == 0 {
+		return RateDecision{}, nil
+	}
+	results, err := l.store.Take(ctx, reqs)
+	if err != nil {
+		return RateDecision{}, err
+	}
+	var d RateDecision
+	for _, res := range results {
+		if res.Wait > d.RetryAfter {
+			d.Reason, d.RetryAfter = "mail", res.Wait
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,36 @@
+package cloudkey
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMailLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := NewMailLimiter(NewMemoryBucketStore(), MailPolicy{Messages: 2, Per: time.Hour}, MailPolicy{Messages: 3, Per: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if d, err := l.Allow(ctx, "alice", "192.0.2.1"); err != nil || !d.Allowed() {
+			t.Fatalf("message %d = %+v, %v; want allowed", i, d, err)
+		}
+	}
+	d, err := l.Allow(ctx, "Alice", "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Allowed() || d.Reason != "mail" || d.RetryAfter <= 0 {
+		t.Errorf("third message to the account = %+v, want rejected with RetryAfter", d)
+	}
+
+	// 同一個 IP 對不同帳號也有上限，被拒絕的請求不扣除帳號的額度
+	if d, _ := l.Allow(ctx, "bob", "192.0.2.1"); !d.Allowed() {
+		t.Errorf("first message to bob = %+v, want allowed", d)
+	}
+	if d, _ := l.Allow(ctx, "carol", "192.0.2.1"); d.Allowed() {
+		t.Error("fourth message from the same IP was allowed")
+	}
+	if d, _ := l.Allow(ctx, "carol", "192.0.2.3"); !d.Allowed() {
+		t.Errorf("message to carol from another IP = %+v, want allowed", d)
+	}
+}
@@ -0,0 +1,166 @@
+package cloudkey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 權限範圍
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeDelete = "delete"
+)
+
+// DefaultScopes 一般登入取得的權限範圍
+var DefaultScopes = []string{ScopeRead, ScopeUpload, ScopeDelete}
+
+var (
+	ErrMissingToken   = errors.New("missing access token")
+	ErrMalformedToken = errors.New("malformed authorization header")
+)
+
+// Principal : 通過驗證的使用者身分
+type Principal struct {
+	UID      int      `json:"uid"`
+	Account  string   `json:"account"`
+	Username string   `json:"username"`
+	Role     string   `json:"role"`
+	Scopes   []string `json:"scopes"`
+
+	// Access Token 的 jti 與到期時間，登出時用於撤銷
+	TokenID   string    `json:"-"`
+	ExpiresAt time.Time `json:"-"`
+
+	// 以 API Key 驗證時的 Key ID，登入 Session 為 0
+	APIKeyID int `json:"-"`
+}
+
+// HasScope :
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal : 將使用者身分放入 context
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext : 從 context 取出使用者身分
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// BearerToken : 解析 Authorization header，格式錯誤時回傳 error 而不會 panic
+func BearerToken(r *http.Request) (string, error) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return "", ErrMissingToken
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", ErrMalformedToken
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", ErrMalformedToken
+	}
+	return token, nil
+}
+
+// Auth : 驗證 Access Token (Bearer 或 Session Cookie) 或 API Key 並將使用者身分放入 request context
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, fromCookie, err := requestToken(r)
+		if err != nil {
+			Unauthorized(w, "invalid_request", err.Error())
+			return
+		}
+		if fromCookie {
+			if err := CheckCSRF(r); err != nil {
+				Forbidden(w, "csrf_failed", err.Error())
+				return
+			}
+		}
+		var p *Principal
+		if IsAPIKey(tokenString) && !fromCookie {
+			p, err = principalFromAPIKey(r.Context(), tokenString)
+		} else {
+			p, err = principalFromToken(tokenString)
+		}
+		if err != nil {
+			Unauthorized(w, "invalid_token", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// RequireScope : 檢查使用者是否具備指定權限範圍
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			Unauthorized(w, "invalid_token", "missing principal")
+			return
+		}
+		if !p.HasScope(scope) {
+			Forbidden(w, "insufficient_scope", fmt.Sprintf("scope %q required", scope))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// principalFromToken :
+func principalFromToken(tokenString string) (*Principal, error) {
+	claims, err := ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		UID:       claims.UID,
+		Account:   claims.Account,
+		Username:  claims.Username,
+		Role:      claims.Role,
+		Scopes:    claims.Scopes(),
+		TokenID:   claims.Id,
+		ExpiresAt: claims.ExpiresTime(),
+	}, nil
+}
+
+// AuthError : 驗證失敗回傳的 JSON 格式
+type AuthError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Unauthorized : 回傳 401
+func Unauthorized(w http.ResponseWriter, code, message string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=%q", code))
+	writeAuthError(w, http.StatusUnauthorized, code, message)
+}
+
+// Forbidden : 回傳 403
+func Forbidden(w http.ResponseWriter, code, message string) {
+	writeAuthError(w, http.StatusForbidden, code, message)
+}
+
+func writeAuthError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AuthError{Error: code, Message: message})
+}
@@ -0,0 +1,354 @@
+package cloudkey
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+)
+
+// OIDCStateTTL 從導向登入頁到回到 callback 的期限
+const OIDCStateTTL = 10 * time.Minute
+
+// OIDC 設定檔格式:
+//
+//	[
+//	  {
+//	    "name": "google",
+//	    "issuer": "https://accounts.google.com",
+//	    "clientId": "xxx.apps.googleusercontent.com",
+//	    "clientSecret": "xxx",
+//	    "redirectUrl": "https://example.com/api/oidc/callback"
+//	  }
+//	]
+//
+// 其他支援 Discovery 的 OpenID Provider (含本機測試用的 mock issuer) 設定方式相同。
+
+// OIDCProvider : OpenID Connect Provider 設定
+type OIDCProvider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectUrl"`
+	Scopes       []string `json:"scopes"`
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+}
+
+// oidcDiscovery : /.well-known/openid-configuration
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCIdentity : 從 ID Token 取得的使用者資訊
+type OIDCIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// OIDCState : 登入流程中保存在 Cookie 的狀態 (已簽章)
+type OIDCState struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.StandardClaims
+}
+
+var (
+	oidcMu        sync.RWMutex
+	oidcProviders = map[string]*OIDCProvider{}
+	oidcClient    = &http.Client{Timeout: 10 * time.Second}
+)
+
+// LoadOIDCProviders : 從設定檔載入 OIDC Provider
+func LoadOIDCProviders(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read oidc providers: %v", err)
+	}
+	var providers []*OIDCProvider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return fmt.Errorf("parse oidc providers: %v", err)
+	}
+
+	m := make(map[string]*OIDCProvider)
+	for _, p := range providers {
+		if p.Name == "" || p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return fmt.Errorf("oidc provider %q: name, issuer, clientId and redirectUrl are required", p.Name)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+		m[p.Name] = p
+	}
+	oidcMu.Lock()
+	oidcProviders = m
+	oidcMu.Unlock()
+	return nil
+}
+
+// OIDCProviderNames : 已設定的 Provider 名稱
+func OIDCProviderNames() []string {
+	oidcMu.RLock()
+	defer oidcMu.RUnlock()
+	names := []string{}
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	return names
+}
+
+// GetOIDCProvider :
+func GetOIDCProvider(name string) (*OIDCProvider, bool) {
+	oidcMu.RLock()
+	defer oidcMu.RUnlock()
+	p, ok := oidcProviders[name]
+	return p, ok
+}
+
+// getJSON :
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover : 取得並快取 Provider 的 endpoint
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := getJSON(ctx, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", d.Issuer, p.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// oauth2Config :
+func (p *OIDCProvider) oauth2Config(d *oidcDiscovery) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectURL,
+		Scopes:       p.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}
+}
+
+// AuthCodeURL : 產生導向 Provider 的登入網址 (authorization code + PKCE)，
+// 並回傳需以 HttpOnly Cookie 保存的簽章狀態
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context) (authURL, stateToken string, err error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	s := &OIDCState{Provider: p.Name}
+	if s.State, err = RandomToken(16); err != nil {
+		return "", "", err
+	}
+	if s.Nonce, err = RandomToken(16); err != nil {
+		return "", "", err
+	}
+	if s.Verifier, err = RandomToken(32); err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	s.IssuedAt = now.Unix()
+	s.ExpiresAt = now.Add(OIDCStateTTL).Unix()
+	if stateToken, err = signClaims(s); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(s.Verifier))
+	authURL = p.oauth2Config(d).AuthCodeURL(s.State,
+		oauth2.SetAuthURLParam("nonce", s.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+	return authURL, stateToken, nil
+}
+
+// ParseOIDCState : 驗證 Cookie 內的狀態，回傳對應的 Provider
+func ParseOIDCState(stateToken, state string) (*OIDCProvider, *OIDCState, error) {
+	s := &OIDCState{}
+	if err := parseClaims(stateToken, s); err != nil {
+		return nil, nil, fmt.Errorf("invalid oidc state: %v", err)
+	}
+	if state == "" || s.State != state {
+		return nil, nil, errors.New("oidc state mismatch")
+	}
+	p, ok := GetOIDCProvider(s.Provider)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown oidc provider %q", s.Provider)
+	}
+	return p, s, nil
+}
+
+// Exchange : 以 authorization code 換取 ID Token 並驗證
+func (p *OIDCProvider) Exchange(ctx context.Context, s *OIDCState, code string) (*OIDCIdentity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, oidcClient)
+	token, err := p.oauth2Config(d).Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", s.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("oidc exchange: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("oidc exchange: missing id_token")
+	}
+	return p.verifyIDToken(ctx, rawIDToken, s.Nonce)
+}
+
+// verifyIDToken : 驗證 ID Token 的簽章、iss、aud、exp 與 nonce
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (*OIDCIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %v", err)
+	}
+
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, fmt.Errorf("invalid id_token: %w", ErrInvalidIssuer)
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, fmt.Errorf("invalid id_token: %w", ErrInvalidAudience)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("invalid id_token: nonce mismatch")
+	}
+
+	id := &OIDCIdentity{Provider: p.Name}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.Name, _ = claims["name"].(string)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+	if id.Subject == "" {
+		return nil, fmt.Errorf("invalid id_token: %w: sub", ErrMissingClaim)
+	}
+	return id, nil
+}
+
+// publicKey : 從 Provider 的 JWKS 取得公鑰，找不到 kid 時重新下載一次
+func (p *OIDCProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok && time.Since(p.fetched) < time.Hour {
+		return key, nil
+	}
+	if p.discovery == nil {
+		return nil, errors.New("oidc provider not discovered")
+	}
+	var set JWKS
+	if err := getJSON(ctx, p.discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch jwks: %v", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if key, err := k.PublicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	p.fetched = time.Now()
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+// PublicKey : 將 JWK 轉為 RSA 或 P-256 公鑰
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,191 @@
+package cloudkey
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// 密碼雜湊格式 (存於 Members.userpassword):
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>      argon2id(password)
+//	$argon2id+mac$v=19$m=65536,t=3,p=2$<salt>$<hash>  argon2id(MAC(password))，MAC 作為 pepper
+//	<base64>                                          舊格式: 未加鹽的 MAC(password)
+//
+// 使用 MAC 的雜湊需另外記錄 MAC 金鑰版本 (Members.macKeyVersion)，
+// 舊格式或舊金鑰版本在登入成功後會自動改存為新格式與目前的金鑰版本。
+const (
+	schemeArgon2id    = "argon2id"
+	schemeArgon2idMAC = "argon2id+mac"
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// 驗證時接受的 argon2id 參數範圍，避免錯誤或惡意的雜湊在登入時耗盡記憶體或造成 panic。
+// SetPasswordHashing 的參數也需在範圍內，否則產生的雜湊無法驗證
+const (
+	maxHashMemory = 1 << 20 // KiB
+	maxHashTime   = 32
+	minSaltLen    = 8
+	minKeyLen     = 16
+)
+
+// PasswordParams : argon2id 參數
+type PasswordParams struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultPasswordParams 依 RFC 9106 建議的低記憶體設定
+var DefaultPasswordParams = PasswordParams{Memory: 64 * 1024, Time: 3, Threads: 2, SaltLen: 16, KeyLen: 32}
+
+var (
+	passwordMu     sync.RWMutex
+	passwordParams = DefaultPasswordParams
+	passwordPepper = true
+)
+
+// SetPasswordHashing : 設定 argon2id 參數以及是否以 MAC 作為 pepper
+func SetPasswordHashing(params PasswordParams, pepper bool) {
+	passwordMu.Lock()
+	passwordParams = params
+	passwordPepper = pepper
+	passwordMu.Unlock()
+}
+
+// currentHashing :
+func currentHashing() (PasswordParams, bool) {
+	passwordMu.RLock()
+	defer passwordMu.RUnlock()
+	return passwordParams, passwordPepper
+}
+
+// HashPassword : 產生加鹽的 argon2id 密碼雜湊，version 為使用的 MAC 金鑰版本
+// (未使用 pepper 時為空字串)
+func HashPassword(password string) (encoded, version string, err error) {
+	params, pepper := currentHashing()
+
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", "", err
+	}
+
+	scheme := schemeArgon2id
+	input := []byte(password)
+	if pepper {
+		if version, err = MacVersion(); err != nil {
+			return "", "", err
+		}
+		mac, err := SignMac(version, password)
+		if err != nil {
+			return "", "", err
+		}
+		scheme = schemeArgon2idMAC
+		input = []byte(mac)
+	}
+
+	hash := argon2.IDKey(input, salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	enc := base64.RawStdEncoding
+	encoded = fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		scheme, argon2.Version, params.Memory, params.Time, params.Threads,
+		enc.EncodeToString(salt), enc.EncodeToString(hash))
+	return encoded, version, nil
+}
+
+// VerifyPassword : 以固定時間比對密碼，version 為儲存時記錄的 MAC 金鑰版本。
+// rehash 為 true 時表示雜湊使用舊格式、舊參數或舊金鑰版本，
+// 呼叫端應在驗證成功後以 HashPassword 重新產生並儲存
+func VerifyPassword(password, encoded, version string) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(encoded, "$") {
+		// 舊格式: MAC(password)
+		mac, err := SignMac(version, password)
+		if err != nil {
+			return false, false, err
+		}
+		ok = subtle.ConstantTimeCompare([]byte(mac), []byte(encoded)) == 1
+		return ok, true, nil
+	}
+
+	scheme, params, salt, hash, err := decodeHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	input := []byte(password)
+	if scheme == schemeArgon2idMAC {
+		mac, err := SignMac(version, password)
+		if err != nil {
+			return false, false, err
+		}
+		input = []byte(mac)
+	}
+
+	other := argon2.IDKey(input, salt, params.Time, params.Memory, params.Threads, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(hash, other) != 1 {
+		return false, false, nil
+	}
+
+	current, pepper := currentHashing()
+	rehash = params.Memory != current.Memory || params.Time != current.Time ||
+		params.Threads != current.Threads || uint32(len(hash)) != current.KeyLen ||
+		(scheme == schemeArgon2idMAC) != pepper
+	// 只有使用 MAC 的雜湊需要比對目前的金鑰版本
+	if scheme == schemeArgon2idMAC && !rehash {
+		primary, err := MacVersion()
+		if err != nil {
+			return false, false, err
+		}
+		rehash = version != primary
+	}
+	return true, rehash, nil
+}
+
+// decodeHash :
+func decodeHash(encoded string) (scheme string, params PasswordParams, salt, hash []byte, err error) {
+	// "", scheme, v=19, m=..,t=..,p=.., salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return "", params, nil, nil, ErrInvalidHash
+	}
+	scheme = parts[1]
+	if scheme != schemeArgon2id && scheme != schemeArgon2idMAC {
+		return "", params, nil, nil, fmt.Errorf("%w: unknown scheme %q", ErrInvalidHash, scheme)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return "", params, nil, nil, fmt.Errorf("%w: unsupported version", ErrInvalidHash)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return "", params, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	// argon2.IDKey 在 t=0 或 p=0 時會 panic
+	if params.Time < 1 || params.Time > maxHashTime || params.Threads < 1 ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > maxHashMemory {
+		return "", params, nil, nil, fmt.Errorf("%w: parameters out of range", ErrInvalidHash)
+	}
+
+	enc := base64.RawStdEncoding
+	if salt, err = enc.DecodeString(parts[4]); err != nil {
+		return "", params, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	if hash, err = enc.DecodeString(parts[5]); err != nil {
+		return "", params, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	// 長度為 0 的雜湊會與任何密碼相符
+	if len(salt) < minSaltLen || len(hash) < minKeyLen {
+		return "", params, nil, nil, fmt.Errorf("%w: salt or hash too short", ErrInvalidHash)
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(hash))
+	return scheme, params, salt, hash, nil
+}
@@ -0,0 +1,166 @@
+package cloudkey
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPasswordParams 測試用的低成本參數
+var testPasswordParams = PasswordParams{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+// setTestMacSigner : 以 LocalMacSigner 設定版本 "1" 與 "2" 兩把金鑰
+func setTestMacSigner(t *testing.T, primary string) {
+	t.Helper()
+	keys := "1:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))) + "\n" +
+		"2:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32))) + "\n"
+	path := filepath.Join(t.TempDir(), "mac.key")
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLocalMacSigner(path, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetMacSigner(s, "1")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	setTestMacSigner(t, "1")
+	SetPasswordHashing(testPasswordParams, true)
+	defer SetPasswordHashing(DefaultPasswordParams, true)
+
+	peppered, version, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1" || !strings.HasPrefix(peppered, "$argon2id+mac$") {
+		t.Fatalf("HashPassword() = %q, %q", peppered, version)
+	}
+	legacy, err := SignMac("", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPasswordHashing(testPasswordParams, false)
+	plain, _, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPasswordHashing(testPasswordParams, true)
+
+	tests := []struct {
+		name       string
+		password   string
+		encoded    string
+		version    string
+		wantOK     bool
+		wantRehash bool
+	}{
+		{name: "correct", password: "correct horse", encoded: peppered, version: "1", wantOK: true},
+		{name: "wrong", password: "correct horse!", encoded: peppered, version: "1"},
+		{name: "wrong mac version", password: "correct horse", encoded: peppered, version: "2"},
+		{name: "legacy mac", password: "correct horse", encoded: legacy, wantOK: true, wantRehash: true},
+		{name: "legacy mac wrong", password: "battery staple", encoded: legacy, wantRehash: true},
+		{name: "without pepper", password: "correct horse", encoded: plain, wantOK: true, wantRehash: true},
+	}
+	for _, tt := range tests {
+		ok, rehash, err := VerifyPassword(tt.password, tt.encoded, tt.version)
+		if err != nil {
+			t.Errorf("%s: VerifyPassword() error = %v", tt.name, err)
+			continue
+		}
+		if ok != tt.wantOK || rehash != tt.wantRehash {
+			t.Errorf("%s: VerifyPassword() = %v, %v; want %v, %v", tt.name, ok, rehash, tt.wantOK, tt.wantRehash)
+		}
+	}
+
+	if _, _, err := VerifyPassword("correct horse", "$argon2id$v=19$broken", ""); err == nil {
+		t.Error("VerifyPassword() with a malformed hash = nil error")
+	}
+}
+
+func TestVerifyPasswordRehash(t *testing.T) {
+	setTestMacSigner(t, "1")
+	SetPasswordHashing(testPasswordParams, true)
+	defer SetPasswordHashing(DefaultPasswordParams, true)
+
+	encoded, version, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// argon2id 參數提高後需重新產生
+	stronger := testPasswordParams
+	stronger.Time = 2
+	SetPasswordHashing(stronger, true)
+	if ok, rehash, err := VerifyPassword("correct horse", encoded, version); err != nil || !ok || !rehash {
+		t.Errorf("after params change VerifyPassword() = %v, %v, %v; want true, true", ok, rehash, err)
+	}
+	SetPasswordHashing(testPasswordParams, true)
+
+	// MAC 金鑰輪替後，舊版本仍可驗證但需重新產生
+	setTestMacSigner(t, "2")
+	ok, rehash, err := VerifyPassword("correct horse", encoded, version)
+	if err != nil || !ok || !rehash {
+		t.Fatalf("after key rotation VerifyPassword() = %v, %v, %v; want true, true", ok, rehash, err)
+	}
+	encoded, version, err = HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "2" {
+		t.Errorf("HashPassword() version = %q, want 2", version)
+	}
+	if ok, rehash, err := VerifyPassword("correct horse", encoded, version); err != nil || !ok || rehash {
+		t.Errorf("rehashed VerifyPassword() = %v, %v, %v; want true, false", ok, rehash, err)
+	}
+}
+
+func TestVerifyPasswordWithoutMacSigner(t *testing.T) {
+	SetMacSigner(nil, "")
+	SetPasswordHashing(testPasswordParams, false)
+	defer SetPasswordHashing(DefaultPasswordParams, true)
+
+	encoded, version, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" || !strings.HasPrefix(encoded, "$argon2id$") {
+		t.Fatalf("HashPassword() = %q, %q", encoded, version)
+	}
+	// 不使用 MAC 的雜湊不需要 MAC 金鑰
+	if ok, rehash, err := VerifyPassword("correct horse", encoded, ""); err != nil || !ok || rehash {
+		t.Errorf("VerifyPassword() = %v, %v, %v; want ok without rehash", ok, rehash, err)
+	}
+	if _, _, err := VerifyPassword("correct horse", "legacy-mac", ""); err == nil {
+		t.Error("legacy hash verified without a MAC signer")
+	}
+}
+
+func TestDecodeHashRejectsParameters(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte(strings.Repeat("s", 16)))
+	hash := base64.RawStdEncoding.EncodeToString([]byte(strings.Repeat("h", 32)))
+	for _, params := range []string{
+		"m=1024,t=0,p=1",
+		"m=1024,t=1,p=0",
+		"m=1024,t=1000,p=1",
+		"m=4,t=1,p=1",
+		"m=4294967295,t=1,p=1",
+		"m=1024,t=1,p=300",
+	} {
+		encoded := "$argon2id$v=19$" + params + "$" + salt + "$" + hash
+		if _, _, _, _, err := decodeHash(encoded); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("decodeHash(%s) error = %v, want ErrInvalidHash", params, err)
+		}
+	}
+	// 長度為 0 的雜湊會與任何密碼相符
+	if _, _, _, _, err := decodeHash("$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$"); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("decodeHash with an empty hash error = %v, want ErrInvalidHash", err)
+	}
+	if _, _, _, _, err := decodeHash("$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + hash); err != nil {
+		t.Errorf("decodeHash with valid parameters: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package cloudkey
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UploadPolicy : 上傳限制，Requests 與 Bytes 為每分鐘的數量 (token bucket，可短暫累積到一分鐘的量)，
+// Concurrent 為同時進行中的上傳數，0 表示不限制
+type UploadPolicy struct {
+	Requests   int
+	Bytes      int64
+	Concurrent int
+}
+
+// 預設規則: 同一帳號可能有多把 API Key，單一 Key 的限制較帳號嚴格
+var (
+	DefaultAccountUploadPolicy = UploadPolicy{Requests: 60, Bytes: 200 << 20, Concurrent: 4}
+	DefaultKeyUploadPolicy     = UploadPolicy{Requests: 30, Bytes: 100 << 20}
+)
+
+// BucketStore : 保存 token bucket 的狀態，多個執行個體需共用同一份資料
+type BucketStore interface {
+	// Take : 同時從多個 bucket 取出 token，只有全部足夠時才扣除，
+	// 回傳順序與 reqs 相同
+	Take(ctx context.Context, reqs []BucketRequest) ([]BucketResult, error)
+}
+
+// BucketRequest : 從容量為 Capacity、每 Per 補滿的 bucket 取出 N 個 token
+type BucketRequest struct {
+	Key      string
+	Capacity float64
+	Per      time.Duration
+	N        float64
+}
+
+// BucketResult : Remaining 為扣除後 (被拒絕時為目前) 的數量，Wait 為不足時需等待的時間
+type BucketResult struct {
+	Remaining float64
+	Wait      time.Duration
+}
+
+// Refill : 計算 bucket 經過 elapsed 之後的 token 數量
+func Refill(tokens, capacity float64, per, elapsed time.Duration) float64 {
+	if elapsed > 0 {
+		tokens += capacity * float64(elapsed) / float64(per)
+	}
+	return math.Min(tokens, capacity)
+}
+
+// TakeTokens : 由已補充的 tokens 扣除每個請求的數量，任一個不足時全部不扣除。
+// 供 BucketStore 實作共用，回傳是否扣除
+func TakeTokens(tokens []float64, reqs []BucketRequest) ([]BucketResult, bool) {
+	results := make([]BucketResult, len(reqs))
+	ok := true
+	for i, req := range reqs {
+		results[i].Remaining = tokens[i]
+		if tokens[i] < req.N {
+			results[i].Wait = time.Duration((req.N - tokens[i]) / req.Capacity * float64(req.Per))
+			ok = false
+		}
+	}
+	if ok {
+		for i, req := range reqs {
+			results[i].Remaining -= req.N
+		}
+	}
+	return results, ok
+}
+
+// UploadAccountKey :
+func UploadAccountKey(account string) string {
+	return "upload:" + AccountKey(account)
+}
+
+// UploadAPIKeyKey :
+func UploadAPIKeyKey(id int) string {
+	return "upload:key:" + strconv.Itoa(id)
+}
+
+// RateDecision : 限制檢查的結果，Limit/Remaining 為請求數，用於回應的 header
+type RateDecision struct {
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	// Reason 被拒絕的原因: requests, bytes 或 concurrency
+	Reason string
+}
+
+// Allowed :
+func (d RateDecision) Allowed() bool {
+	return d.Reason == ""
+}
+
+// UploadLimiter : 依帳號與 API Key 限制上傳頻率、流量與同時上傳數。
+// 同時上傳數只在單一執行個體內計算，避免執行個體中斷時留下無法釋放的計數
+type UploadLimiter struct {
+	store   BucketStore
+	account UploadPolicy
+	key     UploadPolicy
+
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+// NewUploadLimiter :
+func NewUploadLimiter(store BucketStore, account, key UploadPolicy) *UploadLimiter {
+	return &UploadLimiter{store: store, account: account, key: key, inflight: make(map[string]int)}
+}
+
+// Allow : 檢查請求數與上傳量，全部通過時才扣除。apiKeyID 為 0 表示不是以 API Key 上傳
+func (l *UploadLimiter) Allow(ctx context.Context, account string, apiKeyID int, bytes int64) (RateDecision, error) {
+	type limit struct {
+		key    string
+		policy UploadPolicy
+	}
+	limits := []limit{{UploadAccountKey(account), l.account}}
+	if apiKeyID != 0 {
+		limits = append(limits, limit{UploadAPIKeyKey(apiKeyID), l.key})
+	}
+
+	var (
+		reqs    []BucketRequest
+		reasons []string
+	)
+	for _, lim := range limits {
+		p := lim.policy
+		if p.Requests > 0 {
+			reqs = append(reqs, BucketRequest{Key: lim.key + ":requests", Capacity: float64(p.Requests), Per: time.Minute, N: 1})
+			reasons = append(reasons, "requests")
+		}
+		if p.Bytes > 0 {
+			// 超過 bucket 容量的單一檔案，只要 bucket 已滿就允許
+			n := math.Min(float64(bytes), float64(p.Bytes))
+			reqs = append(reqs, BucketRequest{Key: lim.key + ":bytes", Capacity: float64(p.Bytes), Per: time.Minute, N: n})
+			reasons = append(reasons, "bytes")
+		}
+	}
+	if len(reqs) == 0 {
+		return RateDecision{}, nil
+	}
+	results, err := l.store.Take(ctx, reqs)
+	if err != nil {
+		return RateDecision{}, err
+	}
+
+	d := RateDecision{Limit: -1}
+	for i, res := range results {
+		if reasons[i] == "requests" && (d.Limit < 0 || int(res.Remaining) < d.Remaining) {
+			d.Limit, d.Remaining = int(reqs[i].Capacity), int(res.Remaining)
+		}
+		if res.Wait > 0 {
+			if d.Reason == "" {
+				d.Reason = reasons[i]
+			}
+			// 等到所有不足的 bucket 都補充後才會通過
+			if res.Wait > d.RetryAfter {
+				d.RetryAfter = res.Wait
+			}
+		}
+	}
+	if d.Limit < 0 {
+		d.Limit = 0
+	}
+	return d, nil
+}
+
+// Acquire : 佔用一個同時上傳的名額，成功時需呼叫回傳的 release
+func (l *UploadLimiter) Acquire(account string) (release func(), ok bool) {
+	key := UploadAccountKey(account)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.account.Concurrent > 0 && l.inflight[key] >= l.account.Concurrent {
+		return nil, false
+	}
+	l.inflight[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.inflight[key]--; l.inflight[key] <= 0 {
+				delete(l.inflight, key)
+			}
+		})
+	}, true
+}
+
+// bucketSweepInterval MemoryBucketStore 清除已補滿 bucket 的間隔
+const bucketSweepInterval = time.Minute
+
+// MemoryBucketStore : 單一執行個體使用的 BucketStore
+type MemoryBucketStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	per     time.Duration
+}
+
+// NewMemoryBucketStore :
+func NewMemoryBucketStore() *MemoryBucketStore {
+	return &MemoryBucketStore{buckets: make(map[string]*memoryBucket), lastSweep: time.Now()}
+}
+
+// Take :
+func (s *MemoryBucketStore) Take(ctx context.Context, reqs []BucketRequest) ([]BucketResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tokens := make([]float64, len(reqs))
+	for i, req := range reqs {
+		tokens[i] = req.Capacity
+		if b, ok := s.buckets[req.Key]; ok {
+			tokens[i] = Refill(b.tokens, req.Capacity, req.Per, now.Sub(b.updated))
+		}
+	}
+	results, ok := TakeTokens(tokens, reqs)
+	if ok {
+		for i, req := range reqs {
+			s.buckets[req.Key] = &memoryBucket{tokens: results[i].Remaining, updated: now, per: req.Per}
+		}
+	}
+
+	// 定期清除已補滿的 bucket，不在每次請求時掃描全部
+	if now.Sub(s.lastSweep) > bucketSweepInterval {
+		for k, v := range s.buckets {
+			if now.Sub(v.updated) > v.per {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	return results, nil
+}
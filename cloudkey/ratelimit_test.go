@@ -0,0 +1,60 @@
+package cloudkey
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUploadLimiterRejectDoesNotTake(t *testing.T) {
+	ctx := context.Background()
+	l := NewUploadLimiter(NewMemoryBucketStore(), UploadPolicy{Requests: 2, Bytes: 1000}, UploadPolicy{Requests: 5, Bytes: 100})
+
+	d, err := l.Allow(ctx, "bob", 4, 60)
+	if err != nil || !d.Allowed() {
+		t.Fatalf("first upload = %+v, %v; want allowed", d, err)
+	}
+	// API Key 的 bytes 不足時，帳號的請求數不能被扣除
+	for i := 0; i < 3; i++ {
+		d, err = l.Allow(ctx, "bob", 4, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed() || d.Reason != "bytes" {
+			t.Fatalf("attempt %d = %+v, want rejected for bytes", i, d)
+		}
+		if d.RetryAfter <= 0 {
+			t.Errorf("attempt %d RetryAfter = %v, want > 0", i, d.RetryAfter)
+		}
+		// 被拒絕的請求不會用掉帳號的請求數
+		if d.Remaining != 1 {
+			t.Errorf("attempt %d Remaining = %d, want 1", i, d.Remaining)
+		}
+	}
+	if d, err := l.Allow(ctx, "bob", 4, 10); err != nil || !d.Allowed() {
+		t.Fatalf("small upload = %+v, %v; want allowed", d, err)
+	} else if d.Remaining != 0 {
+		t.Errorf("Remaining = %d, want 0", d.Remaining)
+	}
+}
+
+func TestTakeTokensAllOrNothing(t *testing.T) {
+	reqs := []BucketRequest{
+		{Key: "a", Capacity: 10, Per: 60e9, N: 1},
+		{Key: "b", Capacity: 10, Per: 60e9, N: 5},
+	}
+	results, ok := TakeTokens([]float64{10, 4}, reqs)
+	if ok {
+		t.Fatal("TakeTokens ok = true, want false")
+	}
+	if results[0].Remaining != 10 || results[0].Wait != 0 {
+		t.Errorf("results[0] = %+v, want untouched", results[0])
+	}
+	if results[1].Remaining != 4 || results[1].Wait != 6e9 {
+		t.Errorf("results[1] = %+v, want 4 remaining and 6s wait", results[1])
+	}
+
+	results, ok = TakeTokens([]float64{10, 5}, reqs)
+	if !ok || results[0].Remaining != 9 || results[1].Remaining != 0 {
+		t.Errorf("TakeTokens = %+v, %v; want 9 and 0", results, ok)
+	}
+}
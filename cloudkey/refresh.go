@@ -0,0 +1,80 @@
+package cloudkey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RefreshTokenTTL Refresh Token 有效期限
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// RevocationChecker : 檢查 Access Token (jti) 是否已被撤銷
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+var (
+	revocationMu sync.RWMutex
+	revocation   RevocationChecker
+)
+
+// SetRevocationChecker : 設定 ValidateToken 使用的撤銷檢查
+func SetRevocationChecker(c RevocationChecker) {
+	revocationMu.Lock()
+	revocation = c
+	revocationMu.Unlock()
+}
+
+// checkRevoked :
+func checkRevoked(jti string) error {
+	revocationMu.RLock()
+	c := revocation
+	revocationMu.RUnlock()
+	if c == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	revoked, err := c.IsRevoked(ctx, jti)
+	if err != nil {
+		log.Printf("check revocation: %v", err)
+		return errors.New("unable to check token revocation")
+	}
+	if revoked {
+		return fmt.Errorf("token %s has been revoked", jti)
+	}
+	return nil
+}
+
+// RandomToken : 產生 n bytes 的隨機字串 (base64url)
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewRefreshToken : 產生 Refresh Token 與要存入 DB 的雜湊值
+func NewRefreshToken() (token, hash string, err error) {
+	token, err = RandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashToken(token), nil
+}
+
+// HashToken : 以 SHA-256 雜湊高熵值的隨機 Token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,61 @@
+package cloudkey
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// 會員角色
+const (
+	RoleAdmin    = "admin"
+	RoleMember   = "member"
+	RoleReadOnly = "readonly"
+)
+
+// ValidRole :
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleMember, RoleReadOnly:
+		return true
+	}
+	return false
+}
+
+// RoleScopes : 各角色登入後取得的權限範圍
+func RoleScopes(role string) []string {
+	switch role {
+	case RoleAdmin, RoleMember:
+		return DefaultScopes
+	case RoleReadOnly:
+		return []string{ScopeRead}
+	}
+	return nil
+}
+
+// LimitScopes : 只保留角色允許的權限範圍，用於角色變更後仍有效的 API Key
+func LimitScopes(scopes []string, role string) []string {
+	allowed := &Principal{Scopes: RoleScopes(role)}
+	var out []string
+	for _, s := range scopes {
+		if allowed.HasScope(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// RequireRole : 檢查使用者是否為指定角色
+func RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			Unauthorized(w, "invalid_token", "missing principal")
+			return
+		}
+		if p.Role != role {
+			Forbidden(w, "forbidden", fmt.Sprintf("role %q required", role))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,53 @@
+package cloudkey
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// Cookie Session 模式: Token 放在 HttpOnly Cookie，前端無法讀取；
+// 變更狀態的請求需以 double-submit 方式將 CSRFCookie 的值放在 CSRFHeader
+const (
+	SessionCookie = "i2c_session" // Access Token
+	RefreshCookie = "i2c_refresh" // Refresh Token
+	CSRFCookie    = "i2c_csrf"    // 前端可讀取的 CSRF Token
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+var ErrCSRF = errors.New("missing or invalid csrf token")
+
+// NewCSRFToken :
+func NewCSRFToken() (string, error) {
+	return RandomToken(32)
+}
+
+// requestToken : Authorization header 優先，沒有時使用 Session Cookie
+func requestToken(r *http.Request) (token string, fromCookie bool, err error) {
+	token, err = BearerToken(r)
+	if !errors.Is(err, ErrMissingToken) {
+		return token, false, err
+	}
+	c, cerr := r.Cookie(SessionCookie)
+	if cerr != nil || c.Value == "" {
+		return "", false, err
+	}
+	return c.Value, true, nil
+}
+
+// CheckCSRF : 以 Cookie 驗證的請求，除了 GET/HEAD/OPTIONS 之外都需要 CSRF Token
+func CheckCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	c, err := r.Cookie(CSRFCookie)
+	if err != nil || c.Value == "" {
+		return ErrCSRF
+	}
+	header := r.Header.Get(CSRFHeader)
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(header)) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package cloudkey
+
+import "strconv"
+
+// ShareLinkPrefix 公開分享連結 Token 的前綴
+const ShareLinkPrefix = "i2s_"
+
+// NewShareLinkToken : 產生公開分享連結的 Token 與要存入 DB 的雜湊值
+func NewShareLinkToken() (token, hash string, err error) {
+	secret, err := RandomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	token = ShareLinkPrefix + secret
+	return token, HashToken(token), nil
+}
+
+// ShareLinkKey : 分享連結密碼錯誤次數的追蹤 key，套用帳號的鎖定規則
+func ShareLinkKey(id int) string {
+	return "link:" + strconv.Itoa(id)
+}
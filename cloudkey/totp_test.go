@@ -0,0 +1,72 @@
+package cloudkey
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 附錄 B 的 SHA1 測試向量，密鑰為 ASCII "12345678901234567890"，取後 6 位
+func TestTOTPRFC6238(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		counter, ok := VerifyTOTP(secret, tt.code, now)
+		if !ok {
+			t.Errorf("VerifyTOTP(%q) at %d = false", tt.code, tt.unix)
+			continue
+		}
+		if counter != tt.unix/totpPeriod {
+			t.Errorf("VerifyTOTP(%q) at %d counter = %d, want %d", tt.code, tt.unix, counter, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestVerifyTOTPWindow(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name    string
+		counter int64
+		want    bool
+	}{
+		{"current", current, true},
+		{"previous step", current - 1, true},
+		{"next step", current + 1, true},
+		{"two steps ago", current - 2, false},
+		{"two steps ahead", current + 2, false},
+	}
+	for _, tt := range tests {
+		counter, ok := VerifyTOTP(secret, totpCode(key, tt.counter), now)
+		if ok != tt.want || (ok && counter != tt.counter) {
+			t.Errorf("%s: VerifyTOTP() = %d, %v; want %d, %v", tt.name, counter, ok, tt.counter, tt.want)
+		}
+	}
+
+	code := totpCode(key, current)
+	if _, ok := VerifyTOTP(secret, code[:3]+" "+code[3:], now); !ok {
+		t.Error("VerifyTOTP() rejected a code with a space")
+	}
+	if _, ok := VerifyTOTP(secret, "12345", now); ok {
+		t.Error("VerifyTOTP() accepted a short code")
+	}
+}
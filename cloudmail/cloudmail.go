@@ -0,0 +1,116 @@
+package cloudmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message : 寄出的郵件
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer : 寄送郵件
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var mailer Mailer
+
+// Set : 設定寄送郵件的方式
+func Set(m Mailer) {
+	mailer = m
+}
+
+// Send : 以目前設定的 Mailer 寄出郵件
+func Send(ctx context.Context, msg Message) error {
+	if mailer == nil {
+		return errors.New("mailer not configured")
+	}
+	return mailer.Send(ctx, msg)
+}
+
+// SMTPMailer : 透過 SMTP 伺服器寄信 (支援 STARTTLS 與 PLAIN 驗證)
+type SMTPMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+// NewSMTPMailer :
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{host: host, port: port, username: username, password: password, from: from}
+}
+
+// Send :
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return errors.New("invalid header value")
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.from, msg.To, msg.Subject, time.Now().Format(time.RFC1123Z), msg.Body)
+
+	// smtp.SendMail 不支援 context，改在背景執行並等待
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(net.JoinHostPort(m.host, m.port), auth, m.from, []string{msg.To}, []byte(body))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("smtp.SendMail: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CaptureMailer : 不實際寄信，只保留郵件內容並寫入 log，供本機開發與測試使用
+type CaptureMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// maxCaptured CaptureMailer 保留的郵件數，超過時捨棄最舊的郵件
+const maxCaptured = 100
+
+// NewCaptureMailer :
+func NewCaptureMailer() *CaptureMailer {
+	return &CaptureMailer{}
+}
+
+// Send :
+func (m *CaptureMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	m.messages = append(m.messages, msg)
+	if len(m.messages) > maxCaptured {
+		m.messages = m.messages[len(m.messages)-maxCaptured:]
+	}
+	m.mu.Unlock()
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Messages : 目前收到的郵件
+func (m *CaptureMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
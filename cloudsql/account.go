@@ -0,0 +1,336 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudstorage"
+)
+
+// 刪除帳號的狀態
+const (
+	DeletionPending = "pending"
+	DeletionRunning = "running"
+	DeletionDone    = "done"
+	DeletionFailed  = "failed"
+)
+
+// deletionTimeout 單次刪除資料的期限，逾時後在下次啟動時重試
+const deletionTimeout = 10 * time.Minute
+
+// maxDeletionAttempts 刪除失敗的重試上限，超過後需由管理者處理
+const maxDeletionAttempts = 5
+
+// deletePrefix 刪除帳號的 Storage 物件
+var deletePrefix = cloudstorage.DeletePrefix
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type ProfileRequest struct {
+	Username string `json:"username"`
+}
+
+type DeleteAccountRequest struct {
+	// Confirm 需與帳號相同
+	Confirm  string `json:"confirm"`
+	Password string `json:"password"`
+}
+
+// Deletion : 刪除帳號的進度
+type Deletion struct {
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// StatusURL 只在提出刪除時回傳，帳號刪除後仍可查詢進度
+	StatusURL string `json:"statusUrl,omitempty"`
+}
+
+// checkCurrentPassword : 變更帳號前確認目前的密碼，失敗次數與登入共用鎖定
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, db *sql.DB, password string) bool {
+	p := principal(r)
+	keys := []string{cloudkey.AccountKey(p.Account), cloudkey.IPKey(clientIP(r))}
+	if loginLimiter != nil {
+		wait, err := loginLimiter.Check(r.Context(), keys...)
+		if err != nil {
+			log.Printf("Error: unable to check login attempts: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return false
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return false
+		}
+	}
+
+	mid, _, err := verifyMember(db, p.Account, password)
+	if errors.Is(err, errInvalidCredentials) {
+		if loginLimiter != nil {
+			if _, err := loginLimiter.Failure(r.Context(), keys...); err != nil {
+				log.Printf("Error: unable to record login failure: %v", err)
+			}
+		}
+		cloudkey.Forbidden(w, "invalid_password", "current password is incorrect")
+		return false
+	}
+	if err != nil || mid != p.UID {
+		log.Printf("Error: unable to verify password: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// changePassword : 需提供目前的密碼，變更後登出所有裝置
+func changePassword(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, "currentPassword and newPassword are required", http.StatusBadRequest)
+		return
+	}
+	if !checkCurrentPassword(w, r, db, req.CurrentPassword) {
+		return
+	}
+
+	p := principal(r)
+	if err := setPassword(db, p.UID, req.NewPassword); err != nil {
+		log.Printf("Error: unable to change password: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeMemberTokens(db, p.UID); err != nil {
+		log.Printf("Error: unable to revoke tokens: %v", err)
+	}
+	if err := revokeAccessToken(db, p.TokenID, p.ExpiresAt); err != nil {
+		log.Printf("Error: unable to revoke access token: %v", err)
+	}
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateProfile : 變更顯示名稱，下次換發 Access Token 時生效
+func updateProfile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req ProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || utf8.RuneCountInString(req.Username) > 50 {
+		http.Error(w, "username is required (max 50 characters)", http.StatusBadRequest)
+		return
+	}
+	updateUser := "UPDATE Members SET username = @username WHERE mid = @mid"
+	if _, err := db.Exec(updateUser, sql.Named("username", req.Username), sql.Named("mid", principal(r).UID)); err != nil {
+		log.Printf("Error: unable to update profile: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAccount : 停用帳號並在背景刪除所有圖片與資料，回傳可查詢進度的網址
+func deleteAccount(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Confirm != p.Account {
+		http.Error(w, "confirm must match your account", http.StatusBadRequest)
+		return
+	}
+	// OIDC 建立的帳號沒有密碼，只需確認帳號
+	var encoded string
+	if err := db.QueryRow("SELECT userpassword FROM Members WHERE mid = @mid", sql.Named("mid", p.UID)).Scan(&encoded); err != nil {
+		log.Printf("Error: unable to find member: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if encoded != unusablePassword && !checkCurrentPassword(w, r, db, req.Password) {
+		return
+	}
+
+	token, hash, err := cloudkey.NewRefreshToken()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	d := Deletion{Status: DeletionPending, RequestedAt: time.Now().UTC()}
+	var id int
+	addDeletion := `UPDATE Members SET disabled = 1 WHERE mid = @mid
+		INSERT INTO AccountDeletions (mid, account, tokenHash, status, requestedAt) OUTPUT inserted.id VALUES (@mid, @account, @hash, @status, @requestedAt)`
+	err = db.QueryRow(addDeletion,
+		sql.Named("mid", p.UID),
+		sql.Named("account", p.Account),
+		sql.Named("hash", hash),
+		sql.Named("status", d.Status),
+		sql.Named("requestedAt", d.RequestedAt),
+	).Scan(&id)
+	if err != nil {
+		log.Printf("Error: unable to request account deletion: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeMemberTokens(db, p.UID); err != nil {
+		log.Printf("Error: unable to revoke tokens: %v", err)
+	}
+	if err := revokeAccessToken(db, p.TokenID, p.ExpiresAt); err != nil {
+		log.Printf("Error: unable to revoke access token: %v", err)
+	}
+	log.Printf("%s requested account deletion %d", p.Account, id)
+	go runDeletion(db, id, p.UID, p.Account)
+
+	clearSessionCookies(w)
+	d.StatusURL = fmt.Sprintf("%s/api/account/deletion?token=%s", baseURL, token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
+
+// deletionStatus : 以刪除時取得的 token 查詢進度，不需要登入
+func deletionStatus(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var (
+		d           Deletion
+		errMsg      sql.NullString
+		completedAt sql.NullTime
+		attempts    int
+	)
+	findDeletion := "SELECT status, error, requestedAt, completedAt, attempts FROM AccountDeletions WHERE tokenHash = @hash"
+	err := db.QueryRow(findDeletion, sql.Named("hash", cloudkey.HashToken(r.FormValue("token")))).Scan(&d.Status, &errMsg, &d.RequestedAt, &completedAt, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to find account deletion: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// 內部錯誤訊息只寫入 log
+	if errMsg.Valid {
+		d.Error = "deletion failed, it will be retried"
+		if attempts >= maxDeletionAttempts {
+			d.Error = "deletion failed, please contact support"
+		}
+	}
+	if completedAt.Valid {
+		d.CompletedAt = &completedAt.Time
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// ResumeDeletions : 重新執行尚未完成的刪除 (例如執行個體在刪除途中被停止)。
+// 每個執行個體啟動時都會呼叫，由 claimDeletion 確保同一筆刪除只有一個執行個體處理。
+// 刪除在回應之後於背景執行，Cloud Run 需設定 CPU 一律分配 (--no-cpu-throttling)，
+// 否則請求結束後 CPU 受到限制，刪除可能逾時
+func ResumeDeletions() {
+	db := getDB()
+	rows, err := db.Query("SELECT id, mid, account FROM AccountDeletions WHERE status <> @done AND attempts < @maxAttempts",
+		sql.Named("done", DeletionDone), sql.Named("maxAttempts", maxDeletionAttempts))
+	if err != nil {
+		log.Printf("Error: unable to list account deletions: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, mid int
+			account string
+		)
+		if err := rows.Scan(&id, &mid, &account); err != nil {
+			log.Printf("Error: unable to list account deletions: %v", err)
+			return
+		}
+		go runDeletion(db, id, mid, account)
+	}
+}
+
+// claimDeletion : 將刪除標記為執行中，其他執行個體已在處理 (且未逾時) 或超過重試上限時回傳 false
+func claimDeletion(ctx context.Context, db *sql.DB, id int) (bool, error) {
+	claim := `UPDATE AccountDeletions SET status = @running, claimedAt = SYSUTCDATETIME(), attempts = attempts + 1
+		WHERE id = @id AND status IN (@pending, @running, @failed) AND attempts < @maxAttempts
+		AND (claimedAt IS NULL OR claimedAt < @stale)`
+	res, err := db.ExecContext(ctx, claim,
+		sql.Named("id", id),
+		sql.Named("pending", DeletionPending),
+		sql.Named("running", DeletionRunning),
+		sql.Named("failed", DeletionFailed),
+		sql.Named("maxAttempts", maxDeletionAttempts),
+		sql.Named("stale", time.Now().UTC().Add(-deletionTimeout)),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// runDeletion : 取得刪除的執行權後，先刪除 Storage 物件再刪除 DB 資料，失敗時記錄狀態以便重試
+func runDeletion(db *sql.DB, id, mid int, account string) {
+	ctx, cancel := context.WithTimeout(context.Background(), deletionTimeout)
+	defer cancel()
+
+	claimed, err := claimDeletion(ctx, db, id)
+	if err != nil {
+		log.Printf("Error: unable to claim account deletion %d: %v", id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	status, errMsg := DeletionDone, sql.NullString{}
+	if err := deleteAccountData(ctx, db, mid, account); err != nil {
+		log.Printf("Error: account deletion %d failed: %v", id, err)
+		status, errMsg = DeletionFailed, nullString(err.Error())
+	}
+	// 失敗時清除 claimedAt，下次啟動時可立即重試
+	updateDeletion := `UPDATE AccountDeletions SET status = @status, error = @error, claimedAt = NULL,
+		completedAt = CASE WHEN @status = 'done' THEN SYSUTCDATETIME() END WHERE id = @id`
+	if _, err := db.ExecContext(ctx, updateDeletion, sql.Named("status", status), sql.Named("error", errMsg), sql.Named("id", id)); err != nil {
+		log.Printf("Error: unable to update account deletion %d: %v", id, err)
+	}
+}
+
+// deleteAccountData :
+func deleteAccountData(ctx context.Context, db *sql.DB, mid int, account string) error {
+	n, err := deletePrefix(ctx, account+"/")
+	if err != nil {
+		return err
+	}
+	log.Printf("deleted %d objects of %s", n, account)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	deleteRows := `DELETE FROM RefreshTokens WHERE mid = @mid
+		DELETE FROM ApiKeys WHERE mid = @mid
+		DELETE FROM ImageShares WHERE ownerMid = @mid OR granteeMid = @mid
+		DELETE FROM ShareLinks WHERE ownerMid = @mid
+		DELETE FROM MFARecoveryCodes WHERE mid = @mid
+		DELETE FROM MemberMFA WHERE mid = @mid
+		DELETE FROM MemberIdentities WHERE mid = @mid
+		DELETE FROM PasswordResets WHERE mid = @mid
+		DELETE FROM LoginAttempts WHERE attemptKey = @attemptKey
+		DELETE FROM StorageUsage WHERE mid = @mid
+		DELETE FROM images WHERE mid = @mid
+		DELETE FROM Members WHERE mid = @mid`
+	if _, err := tx.ExecContext(ctx, deleteRows, sql.Named("mid", mid), sql.Named("attemptKey", cloudkey.AccountKey(account))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
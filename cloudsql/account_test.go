@@ -0,0 +1,143 @@
+package cloudsql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// stubDeletePrefix : 以記錄呼叫取代 Storage 的刪除
+func stubDeletePrefix(t *testing.T, err error) chan string {
+	t.Helper()
+	prefixes := make(chan string, 10)
+	orig := deletePrefix
+	deletePrefix = func(ctx context.Context, prefix string) (int, error) {
+		prefixes <- prefix
+		return 0, err
+	}
+	t.Cleanup(func() { deletePrefix = orig })
+	return prefixes
+}
+
+// waitDeletion : 等待背景的刪除結束
+func waitDeletion(t *testing.T, store *fakeStore, id int) fakeDeletion {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		store.mu.Lock()
+		d := *store.deletions[id]
+		store.mu.Unlock()
+		if d.status == DeletionDone || d.status == DeletionFailed {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("deletion %d did not finish", id)
+	return fakeDeletion{}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	store, _ := setupTest(t)
+	prefixes := stubDeletePrefix(t, nil)
+	alice, bob := store.addMember("alice"), store.addMember("bob")
+	alice.password = unusablePassword
+	store.addImage("alice", "cat.jpg", "1")
+	store.usage[alice.mid] = &fakeUsage{bytes: 10, images: 1}
+	if rec := callHandler(t, shareImage, alice, http.MethodPost, "/api/share", ShareRequest{Name: "cat.jpg", Account: "bob", Permission: PermissionView}); rec.Code != http.StatusOK {
+		t.Fatalf("share status = %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := callHandler(t, deleteAccount, alice, http.MethodPost, "/api/account/delete", DeleteAccountRequest{Confirm: "bob"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("delete with a wrong confirm status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := callHandler(t, deleteAccount, alice, http.MethodPost, "/api/account/delete", DeleteAccountRequest{Confirm: "alice"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	var d Deletion
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := waitDeletion(t, store, 1); got.status != DeletionDone || got.attempts != 1 {
+		t.Errorf("deletion = %s after %d attempts, want done after 1", got.status, got.attempts)
+	}
+	if prefix := <-prefixes; prefix != "alice/" {
+		t.Errorf("deleted prefix %q, want alice/", prefix)
+	}
+	store.mu.Lock()
+	if store.members[alice.mid] != nil || store.usage[alice.mid] != nil || len(store.shares) != 0 {
+		t.Error("member data was not deleted")
+	}
+	if store.members[bob.mid] == nil {
+		t.Error("another member was deleted")
+	}
+	store.mu.Unlock()
+
+	// 帳號刪除後仍可用 token 查詢進度
+	u, err := url.Parse(d.StatusURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = callAPI(t, http.MethodGet, "/api/account/deletion?token="+url.QueryEscape(u.Query().Get("token")), nil)
+	var status Deletion
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status: %v (status %d)", err, rec.Code)
+	}
+	if status.Status != DeletionDone || status.CompletedAt == nil {
+		t.Errorf("deletion status = %+v, want done", status)
+	}
+}
+
+func TestDeletionClaim(t *testing.T) {
+	store, _ := setupTest(t)
+	ctx := context.Background()
+	store.deletions[1] = &fakeDeletion{mid: 1, account: "alice", status: DeletionPending}
+
+	if ok, err := claimDeletion(ctx, getDB(), 1); err != nil || !ok {
+		t.Fatalf("first claim = %v, %v, want claimed", ok, err)
+	}
+	// 其他執行個體不能取得執行中的刪除，逾時之後才能重新取得
+	if ok, _ := claimDeletion(ctx, getDB(), 1); ok {
+		t.Error("claimed a running deletion")
+	}
+	store.deletions[1].claimedAt = time.Now().UTC().Add(-2 * deletionTimeout)
+	if ok, _ := claimDeletion(ctx, getDB(), 1); !ok {
+		t.Error("could not claim a stale deletion")
+	}
+
+	store.deletions[1].claimedAt = nil
+	store.deletions[1].attempts = maxDeletionAttempts
+	if ok, _ := claimDeletion(ctx, getDB(), 1); ok {
+		t.Error("claimed a deletion past the retry limit")
+	}
+}
+
+func TestResumeDeletionsRetriesFailures(t *testing.T) {
+	store, _ := setupTest(t)
+	stubDeletePrefix(t, errors.New("storage unavailable"))
+	alice := store.addMember("alice")
+	store.deletions[1] = &fakeDeletion{mid: alice.mid, account: "alice", status: DeletionPending}
+
+	ResumeDeletions()
+	d := waitDeletion(t, store, 1)
+	if d.status != DeletionFailed || d.errMsg == nil || d.claimedAt != nil {
+		t.Fatalf("deletion = %+v, want failed and released", d)
+	}
+	if store.member("alice") == nil {
+		t.Error("member was deleted although storage deletion failed")
+	}
+
+	store.mu.Lock()
+	store.deletions[1].attempts = maxDeletionAttempts
+	store.mu.Unlock()
+	ResumeDeletions()
+	time.Sleep(50 * time.Millisecond)
+	if got := store.deletions[1].attempts; got != maxDeletionAttempts {
+		t.Errorf("attempts = %d, want no retry past %d", got, maxDeletionAttempts)
+	}
+}
@@ -0,0 +1,273 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// bootstrapAdmins 啟動時設為 admin 的帳號
+var bootstrapAdmins []string
+
+// SetAdmins : 設定啟動時要設為 admin 的帳號，之後可由管理 API 調整角色
+func SetAdmins(accounts []string) {
+	bootstrapAdmins = nil
+	for _, a := range accounts {
+		if a = strings.TrimSpace(a); a != "" {
+			bootstrapAdmins = append(bootstrapAdmins, a)
+		}
+	}
+}
+
+// promoteAdmins :
+func promoteAdmins(db *sql.DB) error {
+	promote := "UPDATE Members SET role = @role WHERE account = @account AND role <> @role"
+	for _, account := range bootstrapAdmins {
+		if _, err := db.Exec(promote, sql.Named("role", cloudkey.RoleAdmin), sql.Named("account", account)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Member : 管理 API 回傳的會員資料
+type Member struct {
+	MID           int       `json:"mid"`
+	Account       string    `json:"account"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"emailVerified"`
+	Role          string    `json:"role"`
+	Disabled      bool      `json:"disabled"`
+	Created       time.Time `json:"created"`
+}
+
+type MemberStatusRequest struct {
+	Account  string `json:"account"`
+	Disabled bool   `json:"disabled"`
+}
+
+type MemberRoleRequest struct {
+	Account string `json:"account"`
+	Role    string `json:"role"`
+}
+
+// listMembers : 列出會員，以 offset/limit 分頁
+func listMembers(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	listMembers := `SELECT mid, account, username, email, emailVerified, role, disabled, createdTime FROM Members
+		ORDER BY mid OFFSET @offset ROWS FETCH NEXT @limit ROWS ONLY`
+	rows, err := db.Query(listMembers, sql.Named("offset", offset), sql.Named("limit", limit))
+	if err != nil {
+		log.Printf("Error: unable to list members: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var (
+			m     Member
+			email sql.NullString
+		)
+		if err := rows.Scan(&m.MID, &m.Account, &m.Username, &email, &m.EmailVerified, &m.Role, &m.Disabled, &m.Created); err != nil {
+			log.Printf("Error: unable to list members: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		m.Email = email.String
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error: unable to list members: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// setMemberDisabled : 停用或啟用帳號。停用時撤銷 Refresh Token，
+// 已簽發的 Access Token 在 TokenTTL 內到期，API Key 立即失效
+func setMemberDisabled(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req MemberStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	p := principal(r)
+	if req.Disabled && req.Account == p.Account {
+		http.Error(w, "cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	var mid int
+	setDisabled := "UPDATE Members SET disabled = @disabled OUTPUT inserted.mid WHERE account = @account"
+	err := db.QueryRow(setDisabled, sql.Named("disabled", req.Disabled), sql.Named("account", req.Account)).Scan(&mid)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to update member: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if req.Disabled {
+		if err := revokeMemberTokens(db, mid); err != nil {
+			log.Printf("Error: unable to revoke tokens: %v", err)
+		}
+	}
+	log.Printf("%s set %s disabled=%v", p.Account, req.Account, req.Disabled)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setMemberRole : 變更會員角色，下次換發 Access Token 時生效
+func setMemberRole(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req MemberRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	if !cloudkey.ValidRole(req.Role) {
+		http.Error(w, "role must be one of admin, member, readonly", http.StatusBadRequest)
+		return
+	}
+	p := principal(r)
+	// 避免最後一個管理者把自己降級
+	if req.Account == p.Account && req.Role != cloudkey.RoleAdmin {
+		http.Error(w, "cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	setRole := "UPDATE Members SET role = @role WHERE account = @account"
+	res, err := db.Exec(setRole, sql.Named("role", req.Role), sql.Named("account", req.Account))
+	if err != nil {
+		log.Printf("Error: unable to update member: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("%s set %s role=%s", p.Account, req.Account, req.Role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminResetPassword : 登出會員所有裝置並寄出重設密碼連結
+func adminResetPassword(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+
+	var mid int
+	findMember := "SELECT mid FROM Members WHERE account = @account"
+	err := db.QueryRow(findMember, sql.Named("account", req.Account)).Scan(&mid)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to find member: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeMemberTokens(db, mid); err != nil {
+		log.Printf("Error: unable to revoke tokens: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	err = sendPasswordReset(r.Context(), db, req.Account)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Member has no verified email", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to send password reset: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s reset password of %s", principal(r).Account, req.Account)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// storageUsage : 各帳號的使用量與上限，依使用量排序，可用 account 參數查詢單一帳號。
+// 列出所有會員，尚未建立使用量紀錄的帳號標示為 unseeded；查詢單一帳號時直接由 Storage 建立紀錄
+func storageUsage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	account := r.FormValue("account")
+	listUsage := `SELECT m.mid, m.account, u.bytes, u.images, m.quotaBytes, m.quotaImages
+		FROM Members m LEFT JOIN StorageUsage u ON u.mid = m.mid
+		WHERE @account = '' OR m.account = @account
+		ORDER BY u.bytes DESC, m.account`
+	rows, err := db.QueryContext(r.Context(), listUsage, sql.Named("account", account))
+	if err != nil {
+		log.Printf("Error: unable to get storage usage: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := []UsageResponse{}
+	var unseeded []int
+	for rows.Next() {
+		var (
+			u                       UsageResponse
+			mid                     int
+			bytes, images           sql.NullInt64
+			quotaBytes, quotaImages sql.NullInt64
+		)
+		if err := rows.Scan(&mid, &u.Account, &bytes, &images, &quotaBytes, &quotaImages); err != nil {
+			log.Printf("Error: unable to get storage usage: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		u.Bytes, u.Images = bytes.Int64, int(images.Int64)
+		u.Limit = quotaLimit(quotaBytes, quotaImages)
+		u.Unseeded = !bytes.Valid
+		if u.Unseeded {
+			unseeded = append(unseeded, mid)
+		}
+		result = append(result, u)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error: unable to get storage usage: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// 單一帳號只需掃描一次 Storage，直接建立使用量紀錄
+	if account != "" && len(result) == 1 && len(unseeded) == 1 {
+		u, err := accountUsage(r.Context(), db, unseeded[0], result[0].Account)
+		if err != nil {
+			log.Printf("Error: unable to get storage usage: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		u.Account = result[0].Account
+		result[0] = u
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,201 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+type APIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type APIKeyRevokeRequest struct {
+	ID int `json:"id"`
+}
+
+// APIKey : 列表時回傳的資訊，不含 Key 本身
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Created    time.Time  `json:"created"`
+}
+
+type APIKeyCreateResponse struct {
+	APIKey
+	// Key 只會在建立時回傳一次
+	Key string `json:"key"`
+}
+
+// createAPIKey : 建立具名的 API Key
+func createAPIKey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "name is required (max 100 characters)", http.StatusBadRequest)
+		return
+	}
+	scopes, err := cloudkey.ParseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 不能建立比目前 Session 權限更大的 Key
+	for _, s := range scopes {
+		if !p.HasScope(s) {
+			cloudkey.Forbidden(w, "insufficient_scope", "cannot grant scope "+s)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "expiresInDays must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	key, hash, hint, err := cloudkey.NewAPIKey()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	resp := APIKeyCreateResponse{
+		APIKey: APIKey{Name: req.Name, Hint: hint, Scopes: scopes, Created: time.Now().UTC()},
+		Key:    key,
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresInDays > 0 {
+		t := resp.Created.AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = sql.NullTime{Time: t, Valid: true}
+		resp.ExpiresAt = &t
+	}
+
+	addKey := "INSERT INTO ApiKeys (mid, name, hint, keyHash, scopes, expiresAt, createdTime) OUTPUT inserted.id VALUES (@mid, @name, @hint, @hash, @scopes, @expiresAt, @created)"
+	err = db.QueryRow(addKey,
+		sql.Named("mid", p.UID),
+		sql.Named("name", req.Name),
+		sql.Named("hint", hint),
+		sql.Named("hash", hash),
+		sql.Named("scopes", strings.Join(scopes, " ")),
+		sql.Named("expiresAt", expiresAt),
+		sql.Named("created", resp.Created),
+	).Scan(&resp.ID)
+	if err != nil {
+		log.Printf("Error: unable to create api key: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listAPIKeys : 列出尚未撤銷的 API Key
+func listAPIKeys(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	listKeys := "SELECT id, name, hint, scopes, expiresAt, lastUsedAt, createdTime FROM ApiKeys WHERE mid = @mid AND revokedAt IS NULL ORDER BY createdTime DESC"
+	rows, err := db.Query(listKeys, sql.Named("mid", principal(r).UID))
+	if err != nil {
+		log.Printf("Error: unable to list api keys: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var (
+			k                     APIKey
+			scopes                string
+			expiresAt, lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&k.ID, &k.Name, &k.Hint, &scopes, &expiresAt, &lastUsedAt, &k.Created); err != nil {
+			log.Printf("Error: unable to list api keys: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		k.Scopes = strings.Fields(scopes)
+		if expiresAt.Valid {
+			k.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			k.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error: unable to list api keys: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// revokeAPIKey : 撤銷自己的 API Key
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req APIKeyRevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	revokeKey := "UPDATE ApiKeys SET revokedAt = SYSUTCDATETIME() WHERE id = @id AND mid = @mid AND revokedAt IS NULL"
+	res, err := db.Exec(revokeKey, sql.Named("id", req.ID), sql.Named("mid", principal(r).UID))
+	if err != nil {
+		log.Printf("Error: unable to revoke api key: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIKeyLookup : 以 ApiKeys 資料表實作 cloudkey.APIKeyResolver
+type APIKeyLookup struct{}
+
+// ResolveAPIKey :
+func (APIKeyLookup) ResolveAPIKey(ctx context.Context, hash string) (*cloudkey.Principal, error) {
+	var (
+		p      cloudkey.Principal
+		scopes string
+	)
+	findKey := `SELECT k.id, k.scopes, m.mid, m.account, m.username, m.role FROM ApiKeys k JOIN Members m ON m.mid = k.mid
+		WHERE k.keyHash = @hash AND k.revokedAt IS NULL AND (k.expiresAt IS NULL OR k.expiresAt > SYSUTCDATETIME()) AND m.disabled = 0`
+	err := getDB().QueryRowContext(ctx, findKey, sql.Named("hash", hash)).Scan(&p.APIKeyID, &scopes, &p.UID, &p.Account, &p.Username, &p.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, cloudkey.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 會員角色變更後，既有 Key 的權限也跟著縮小
+	p.Scopes = cloudkey.LimitScopes(strings.Fields(scopes), p.Role)
+
+	// 最後使用時間只供參考，每分鐘最多更新一次
+	touchKey := "UPDATE ApiKeys SET lastUsedAt = SYSUTCDATETIME() WHERE id = @id AND (lastUsedAt IS NULL OR lastUsedAt < DATEADD(minute, -1, SYSUTCDATETIME()))"
+	if _, err := getDB().ExecContext(ctx, touchKey, sql.Named("id", p.APIKeyID)); err != nil {
+		log.Printf("Error: unable to update api key usage: %v", err)
+	}
+	return &p, nil
+}
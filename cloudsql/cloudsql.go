@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -13,7 +12,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/rellik24/image2cloud/cloudimage"
 	"github.com/rellik24/image2cloud/cloudkey"
 	"github.com/rellik24/image2cloud/cloudstorage"
 )
@@ -26,11 +24,19 @@ var (
 type LoginRequest struct {
 	Account  string `json:"account"`
 	Username string `json:"username"`
+	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Cookie 為 true 時以 HttpOnly Cookie 保存 Token
+	Cookie bool `json:"cookie"`
 }
 
 type LoginResponse struct {
-	AccessToken string `json:"accessToken"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	ExpiresIn    int    `json:"expiresIn,omitempty"`
+	MFARequired  bool   `json:"mfaRequired,omitempty"`
+	MFAToken     string `json:"mfaToken,omitempty"`
+	CSRFToken    string `json:"csrfToken,omitempty"`
 }
 
 // getDB lazily instantiates a database connection pool. Users of Cloud Run or
@@ -72,9 +78,12 @@ func mustConnect() *sql.DB {
 		log.Fatal("Missing database connection type. Please define one of INSTANCE_HOST or INSTANCE_CONNECTION_NAME")
 	}
 
-	// if err := migrateDB(db); err != nil {
-	// 	log.Fatalf("unable to create table: %s", err)
-	// }
+	if err := migrateDB(db); err != nil {
+		log.Fatalf("unable to create table: %s", err)
+	}
+	if err := promoteAdmins(db); err != nil {
+		log.Fatalf("unable to promote admins: %s", err)
+	}
 
 	return db
 }
@@ -104,16 +113,109 @@ func configureConnectionPool(db *sql.DB) {
 	// [END cloud_sql_sqlserver_databasesql_timeout]
 }
 
+// publicAPI 不需要 Access Token 的 API
+var publicAPI = map[string]bool{
+	"/api/signUp":           true,
+	"/api/login":            true,
+	"/api/token/refresh":    true,
+	"/api/login/mfa":        true,
+	"/api/verify":           true,
+	"/api/verify/resend":    true,
+	"/api/password/forgot":  true,
+	"/api/password/reset":   true,
+	"/api/oidc/providers":   true,
+	"/api/oidc/login":       true,
+	"/api/oidc/callback":    true,
+	"/api/account/deletion": true,
+}
+
+// apiScopes 各 API 需要的權限範圍
+var apiScopes = map[string]string{
+	"/api/list":         cloudkey.ScopeRead,
+	"/api/download":     cloudkey.ScopeRead,
+	"/api/download/zip": cloudkey.ScopeRead,
+	"/api/view":         cloudkey.ScopeRead,
+	"/api/shared":       cloudkey.ScopeRead,
+	"/api/shares":       cloudkey.ScopeRead,
+	"/api/usage":        cloudkey.ScopeRead,
+	"/api/upload":       cloudkey.ScopeUpload,
+	"/api/share":        cloudkey.ScopeUpload,
+	"/api/share/revoke": cloudkey.ScopeUpload,
+	"/api/links":        cloudkey.ScopeRead,
+	"/api/links/create": cloudkey.ScopeUpload,
+	"/api/links/revoke": cloudkey.ScopeUpload,
+}
+
+// sessionAPI 只能以登入 Session 使用，API Key 不可管理帳號安全設定
+var sessionAPI = map[string]bool{
+	"/api/logout":           true,
+	"/api/mfa/enroll":       true,
+	"/api/mfa/activate":     true,
+	"/api/mfa/disable":      true,
+	"/api/keys":             true,
+	"/api/keys/create":      true,
+	"/api/keys/revoke":      true,
+	"/api/account/password": true,
+	"/api/account/profile":  true,
+	"/api/account/delete":   true,
+}
+
+// adminAPI 管理 API 的路徑前綴，一律需要 admin 角色且不能以 API Key 使用
+const adminAPI = "/api/admin/"
+
 // API function handles HTTP requests
 func API(w http.ResponseWriter, r *http.Request) {
+	var h http.Handler
 	switch r.Method {
 	case http.MethodGet:
-		getHandler(w, r, getDB())
+		h = withDB(getHandler)
 	case http.MethodPost:
-		postHandler(w, r, getDB())
+		h = withDB(postHandler)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !publicAPI[r.URL.Path] && !isShareLink(r) {
+		admin := strings.HasPrefix(r.URL.Path, adminAPI)
+		if admin {
+			h = cloudkey.RequireRole(cloudkey.RoleAdmin, h)
+		}
+		if admin || sessionAPI[r.URL.Path] {
+			h = requireSession(h)
+		}
+		if scope, ok := apiScopes[r.URL.Path]; ok {
+			h = cloudkey.RequireScope(scope, h)
+		}
+		h = cloudkey.Auth(h)
+	}
+	h.ServeHTTP(w, r)
+}
+
+// withDB :
+func withDB(f func(http.ResponseWriter, *http.Request, *sql.DB)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f(w, r, getDB())
+	})
+}
+
+// requireSession : 拒絕以 API Key 驗證的請求
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal(r).APIKeyID != 0 {
+			cloudkey.Forbidden(w, "session_required", "api keys cannot access this endpoint")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// principal : 取得 cloudkey.Auth 放入的使用者身分
+func principal(r *http.Request) *cloudkey.Principal {
+	p, ok := cloudkey.FromContext(r.Context())
+	if !ok {
+		return &cloudkey.Principal{}
 	}
+	return p
 }
 
 type Image struct {
@@ -125,6 +227,29 @@ type Image struct {
 	Version  string `json:"version"`
 }
 
+// listImages : 帳號擁有的所有圖片 (含各版本)
+func listImages(db *sql.DB, account string) ([]Image, error) {
+	listQuery := "exec ListImage @account"
+	rows, err := db.Query(listQuery, sql.Named("account", account))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Image
+	for rows.Next() {
+		var img Image
+		if err := rows.Scan(&img.Name, &img.FileSize, &img.FileUnit, &img.Created, &img.Link, &img.Version); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, img.Created); err == nil {
+			img.Created = t.Format("2006-01-02 15:04:05")
+		}
+		result = append(result, img)
+	}
+	return result, rows.Err()
+}
+
 // getHandler:
 func getHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	if err := r.ParseForm(); err != nil {
@@ -133,47 +258,32 @@ func getHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	accessToken := r.Header.Get("Authorization")
-	accessToken = strings.Split(accessToken, " ")[1]
-	account, err := authToken(accessToken)
-	if err != nil {
-		http.Error(w, "Invalid Access Token", http.StatusForbidden)
-		return
-	}
-	queryName := strings.Split(r.RequestURI, "?")[0]
+	account := principal(r).Account
+	queryName := r.URL.Path
 	switch queryName {
 	case "/api/list":
-		listQuery := "exec ListImage @account"
-		rows, err := db.Query(listQuery, sql.Named("account", account))
+		result, err := listImages(db, account)
 		if err != nil {
 			log.Printf("Error: unable get image list: %v", err.Error())
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		var result []Image
-		for rows.Next() {
-			var img Image
-			if err := rows.Scan(&img.Name, &img.FileSize, &img.FileUnit, &img.Created, &img.Link, &img.Version); err != nil {
-				return
-			}
-			if t, err := time.Parse(time.RFC3339, img.Created); err == nil {
-				img.Created = t.Format("2006-01-02 15:04:05")
-			}
-			result = append(result, img)
-		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
 	case "/api/download":
+		if isShareLink(r) {
+			downloadShareLink(w, r, db)
+			return
+		}
 		filename := r.FormValue("filename")
-		downloadFile := "exec dbo.DownloadImage @account, @filename"
-		var result int
-		if err := db.QueryRow(downloadFile, sql.Named("account", account), sql.Named("filename", filename)).Scan(&result); err != nil {
+		ok, err := canAccessImage(db, account, principal(r).UID, filename, PermissionDownload)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			log.Println(err.Error())
 			return
 		}
-		if result != 0 {
-			if err := cloudstorage.DownloadFile(w, filename, "download"); err != nil {
+		if ok {
+			if err := serveObject(w, filename, downloadName(db, filename)); err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				log.Println(err.Error())
 				return
@@ -182,6 +292,45 @@ func getHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			w.WriteHeader(http.StatusBadRequest)
 			log.Println("Invalid image name")
 		}
+	case "/api/view":
+		filename := r.FormValue("filename")
+		ok, err := canAccessImage(db, account, principal(r).UID, filename, PermissionView)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println(err.Error())
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid image name", http.StatusNotFound)
+			return
+		}
+		if err := cloudstorage.ViewFile(w, filename); err != nil {
+			log.Println(err.Error())
+		}
+	case "/api/shares":
+		listShares(w, r, db)
+	case "/api/shared":
+		listSharedWithMe(w, r, db)
+	case "/api/links":
+		listShareLinks(w, r, db)
+	case "/api/usage":
+		usage(w, r, db)
+	case "/api/account/deletion":
+		deletionStatus(w, r, db)
+	case "/api/verify":
+		verifyEmail(w, r, db)
+	case "/api/keys":
+		listAPIKeys(w, r, db)
+	case "/api/admin/members":
+		listMembers(w, r, db)
+	case "/api/admin/usage":
+		storageUsage(w, r, db)
+	case "/api/oidc/providers":
+		oidcProviders(w, r)
+	case "/api/oidc/login":
+		oidcLogin(w, r)
+	case "/api/oidc/callback":
+		oidcCallback(w, r, db)
 	default:
 		http.Error(w, "Invalid API", http.StatusBadRequest)
 	}
@@ -189,12 +338,19 @@ func getHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 // postHandler:
 func postHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !limitBody(w, r) {
+		return
+	}
 	if err := r.ParseForm(); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		log.Printf("Post: failed to parse form: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	queryName := strings.Split(r.RequestURI, "?")[0]
+	queryName := r.URL.Path
 	switch queryName {
 	case "/api/signUp":
 		var req LoginRequest
@@ -202,25 +358,36 @@ func postHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if req.Account == "" || req.Username == "" || req.Password == "" {
+		if req.Account == "" || req.Username == "" || req.Password == "" || !validEmail(req.Email) {
 			log.Printf("Add member error")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		password, err := cloudkey.SignMac(w, req.Password)
+		// 帳號會成為 Storage 的物件路徑
+		if !cloudstorage.ValidAccount(req.Account) {
+			http.Error(w, "Invalid account, use letters, digits and . _ @ + -", http.StatusBadRequest)
+			return
+		}
+		password, keyVersion, err := cloudkey.HashPassword(req.Password)
 		if err != nil {
 			log.Println(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
 		// [START cloud_sql_sqlserver_databasesql_connection]
-		addUser := "INSERT INTO Members (account, username, userpassword, createdTime) VALUES (@account, @username, @password, GETDATE())"
-		if _, err = db.Exec(addUser, sql.Named("account", req.Account), sql.Named("username", req.Username), sql.Named("password", password)); err != nil {
+		// 新帳號需完成 Email 驗證後才能登入
+		var mid int
+		addUser := "INSERT INTO Members (account, username, email, emailVerified, userpassword, macKeyVersion, createdTime) OUTPUT inserted.mid VALUES (@account, @username, @email, 0, @password, @keyVersion, GETDATE())"
+		if err = db.QueryRow(addUser, sql.Named("account", req.Account), sql.Named("username", req.Username), sql.Named("email", req.Email), sql.Named("password", password), sql.Named("keyVersion", nullString(keyVersion))).Scan(&mid); err != nil {
 			log.Printf("Error: unable to add user: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 		// [END cloud_sql_sqlserver_databasesql_connection]
-		fmt.Fprintf(w, "Member successfully add: %s!", req.Username)
+		if err := sendVerification(r.Context(), mid, req.Account, req.Username, req.Email); err != nil {
+			log.Printf("Error: unable to send verification: %v", err)
+		}
+		fmt.Fprintf(w, "Member successfully add: %s! Please check your email to verify the account.", req.Username)
 
 	case "/api/login":
 		var req LoginRequest
@@ -233,133 +400,130 @@ func postHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		password, err := cloudkey.SignMac(w, req.Password)
-		if err != nil {
-			log.Println(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
+		// 先檢查鎖定狀態，避免被鎖定的請求仍消耗 KMS 呼叫
+		keys := []string{cloudkey.AccountKey(req.Account), cloudkey.IPKey(clientIP(r))}
+		if loginLimiter != nil {
+			wait, err := loginLimiter.Check(r.Context(), keys...)
+			if err != nil {
+				log.Printf("Error: unable to check login attempts: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
 		}
-		verifyUser := "EXEC dbo.VerifyUser @account, @password"
 
-		var mid int
-		var username string
+		mid, username, err := verifyMember(db, req.Account, req.Password)
+		if errors.Is(err, errInvalidCredentials) && loginLimiter != nil {
+			if _, err := loginLimiter.Failure(r.Context(), keys...); err != nil {
+				log.Printf("Error: unable to record login failure: %v", err)
+			}
+		}
+		if errors.Is(err, errAccountDisabled) {
+			cloudkey.Forbidden(w, "account_disabled", "account disabled")
+			return
+		}
+		if errors.Is(err, errEmailNotVerified) {
+			cloudkey.Forbidden(w, "email_not_verified", "please verify your email address first")
+			return
+		}
 		resp := LoginResponse{AccessToken: ""}
 		w.Header().Set("Content-Type", "application/json")
-
-		if err := db.QueryRow(verifyUser, sql.Named("account", req.Account), sql.Named("password", password)).Scan(&mid, &username); err != nil {
+		if err != nil {
 			log.Printf("Error: unable to login: %v", err)
 			json.NewEncoder(w).Encode(resp)
 			return
 		}
-		accessToken, err := cloudkey.CreateToken(mid, req.Account, username)
+
+		// 已啟用 TOTP 時先回傳 MFA Token，驗證碼通過後才簽發 Access Token
+		enabled, err := mfaEnabled(db, mid)
 		if err != nil {
-			log.Println(err.Error())
+			log.Printf("Error: unable to check mfa: %v", err)
 			json.NewEncoder(w).Encode(resp)
 			return
 		}
-		resp = LoginResponse{AccessToken: accessToken}
-		json.NewEncoder(w).Encode(resp)
-	case "/api/upload":
-		accessToken := r.Header.Get("Authorization")
-		accessToken = strings.Split(accessToken, " ")[1]
-		account, err := authToken(accessToken)
-		if err != nil {
-			http.Error(w, "Invalid Access Token", http.StatusForbidden)
-			return
-		}
-		switch queryName {
-		case "/api/upload":
-			// 取得檔案
-			file, header, err := r.FormFile("file")
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				log.Println(err.Error())
-				return
-			}
-			defer file.Close()
-
-			if _, err := os.Stat(cloudimage.DirPath); os.IsNotExist(err) {
-				err = os.Mkdir(cloudimage.DirPath, 0755)
-				if err != nil {
-					return
-				}
-			}
-
-			// 儲存檔案
-			filename := header.Filename
-			var version int
-
-			checkVersion := "select count(*)+1 from images i , members m where m.account = @account and i.Name = @filename and i.mid = m.mid"
-			if err := db.QueryRow(checkVersion, sql.Named("account", account), sql.Named("filename", filename)).Scan(&version); err != nil {
-				return
-			}
-			tmp := strings.Split(header.Filename, ".")
-			linkName := fmt.Sprintf("%s_v%d.%s", tmp[0], version, tmp[1])
-			out, err := os.Create(fmt.Sprintf("%s%s", cloudimage.DirPath, linkName))
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Println(err.Error())
-				return
-			}
-			defer out.Close()
-
-			if _, err := io.Copy(out, file); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Println(err.Error())
-				return
-			}
-			tmpFile := fmt.Sprintf("%s%s", cloudimage.DirPath, linkName)
-			fileInfo, err := os.Stat(tmpFile)
+		if enabled {
+			mfaToken, err := cloudkey.CreateMFAToken(mid, req.Account, username)
 			if err != nil {
-				fmt.Println("Error:", err)
-				return
-			}
-			fileSize := float64(fileInfo.Size()) / 1024.0 / 1024.0
-			var sizeUnit string
-			if fileSize < 1.0 {
-				fileSize *= 1024.0
-				sizeUnit = "KB"
-			} else {
-				sizeUnit = "MB"
-			}
-			fileSizeStr := fmt.Sprintf("%.2f", fileSize)
-
-			// 上傳
-			if err := cloudstorage.UploadFile(w, account, linkName); err != nil {
-				w.WriteHeader(http.StatusBadRequest)
 				log.Println(err.Error())
+				json.NewEncoder(w).Encode(resp)
 				return
 			}
+			json.NewEncoder(w).Encode(LoginResponse{MFARequired: true, MFAToken: mfaToken})
+			return
+		}
 
-			// 上傳成功記錄 DB
-			uploadFile := "exec dbo.InsertImage @account, @filename, @fileSize, @sizeUnit, @linkname, @version"
-			if _, err := db.Exec(uploadFile, sql.Named("account", account), sql.Named("filename", filename), sql.Named("fileSize", fileSizeStr), sql.Named("sizeUnit", sizeUnit), sql.Named("linkName", linkName), sql.Named("version", version)); err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				log.Println(err.Error())
-				return
+		if loginLimiter != nil {
+			if err := loginLimiter.Success(r.Context(), req.Account); err != nil {
+				log.Printf("Error: unable to reset login attempts: %v", err)
 			}
-
-			// 移除暫存
-			os.Remove(tmpFile)
-
-			// 回傳成功訊息
-			w.WriteHeader(http.StatusOK)
 		}
+		resp, err = issueTokens(db, mid, "")
+		if err != nil {
+			log.Println(err.Error())
+			json.NewEncoder(w).Encode(LoginResponse{})
+			return
+		}
+		if err := writeTokens(w, resp, req.Cookie); err != nil {
+			log.Println(err.Error())
+		}
+	case "/api/token/refresh":
+		refreshToken(w, r, db)
+	case "/api/logout":
+		logout(w, r, db)
+	case "/api/login/mfa":
+		loginMFA(w, r, db)
+	case "/api/verify/resend":
+		resendVerification(w, r, db)
+	case "/api/password/forgot":
+		forgotPassword(w, r, db)
+	case "/api/password/reset":
+		resetPassword(w, r, db)
+	case "/api/mfa/enroll":
+		enrollMFA(w, r, db)
+	case "/api/mfa/activate":
+		activateMFA(w, r, db)
+	case "/api/mfa/disable":
+		disableMFA(w, r, db)
+	case "/api/admin/unlock":
+		unlockLogin(w, r)
+	case "/api/admin/members/disable":
+		setMemberDisabled(w, r, db)
+	case "/api/admin/members/role":
+		setMemberRole(w, r, db)
+	case "/api/admin/quota":
+		setQuota(w, r, db)
+	case "/api/admin/members/password":
+		adminResetPassword(w, r, db)
+	case "/api/keys/create":
+		createAPIKey(w, r, db)
+	case "/api/keys/revoke":
+		revokeAPIKey(w, r, db)
+	case "/api/share":
+		shareImage(w, r, db)
+	case "/api/share/revoke":
+		revokeShare(w, r, db)
+	case "/api/account/password":
+		changePassword(w, r, db)
+	case "/api/account/profile":
+		updateProfile(w, r, db)
+	case "/api/account/delete":
+		deleteAccount(w, r, db)
+	case "/api/links/create":
+		createShareLink(w, r, db)
+	case "/api/links/revoke":
+		revokeShareLink(w, r, db)
+	case "/api/download":
+		// 有密碼的分享連結以 POST 送出密碼
+		downloadShareLink(w, r, db)
+	case "/api/download/zip":
+		downloadZip(w, r, db)
+	case "/api/upload":
+		uploadImages(w, r, db)
 
 	default:
 		http.Error(w, "Invalid API", http.StatusBadRequest)
 	}
 }
-
-// authToken :
-func authToken(accessToken string) (string, error) {
-	claim, err := cloudkey.ValidateToken(accessToken)
-	if err != nil {
-		log.Println(err.Error())
-		return "", err
-	}
-	account, ok := claim["account"].(string)
-	if !ok {
-		return "", errors.New("parse access token error")
-	}
-	return account, nil
-}
@@ -0,0 +1,181 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rellik24/image2cloud/cloudstorage"
+)
+
+// maxZipEntries 一次打包下載的圖片數
+const maxZipEntries = 500
+
+// serveObject 以附件方式回傳 Storage 物件
+var serveObject = cloudstorage.DownloadFile
+
+type ZipRequest struct {
+	// Links 要下載的物件路徑，可包含其他帳號分享的圖片
+	Links []string `json:"links"`
+	// 沒有 Links 時依條件選取自己的圖片，Name 空白時為所有圖片
+	Name string `json:"name"`
+	// Latest 每個名稱只取最新版本
+	Latest bool `json:"latest"`
+}
+
+// downloadName : 下載時使用上傳時的檔名，找不到時由 DownloadFile 使用物件名稱
+func downloadName(db *sql.DB, link string) string {
+	owner, _, ok := strings.Cut(link, "/")
+	if !ok {
+		return ""
+	}
+	img, err := findImage(db, owner, link)
+	if err != nil {
+		log.Printf("Error: unable to find image: %v", err)
+		return ""
+	}
+	if img == nil {
+		return ""
+	}
+	return img.Name
+}
+
+// downloadZip : 將多張圖片以 ZIP 串流下載，每張圖片的權限與單張下載相同
+func downloadZip(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req ZipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Links) > maxZipEntries {
+		http.Error(w, fmt.Sprintf("too many images, at most %d per download", maxZipEntries), http.StatusBadRequest)
+		return
+	}
+
+	var images []Image
+	if len(req.Links) > 0 {
+		var ok bool
+		if images, ok = selectLinks(w, db, p.Account, p.UID, req.Links); !ok {
+			return
+		}
+	} else {
+		var err error
+		if images, err = selectImages(db, p.Account, req.Name, req.Latest); err != nil {
+			log.Printf("Error: unable get image list: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(images) == 0 {
+		http.Error(w, "No images", http.StatusNotFound)
+		return
+	}
+	if len(images) > maxZipEntries {
+		http.Error(w, fmt.Sprintf("too many images, at most %d per download", maxZipEntries), http.StatusBadRequest)
+		return
+	}
+
+	// 開始傳送後無法再變更狀態碼，發生錯誤時 ZIP 會不完整
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", cloudstorage.ContentDisposition("attachment", "images.zip"))
+	if err := cloudstorage.ZipFiles(r.Context(), w, zipEntries(images)); err != nil {
+		log.Printf("Error: unable to stream zip for %s: %v", p.Account, err)
+	}
+}
+
+// selectLinks : 依序確認每張圖片的下載權限，有任何一張無法存取時回應 404，失敗時已回應錯誤
+func selectLinks(w http.ResponseWriter, db *sql.DB, account string, mid int, links []string) ([]Image, bool) {
+	// 同一個擁有者的圖片只查詢一次
+	access := newImageAccess(db, account, mid)
+	seen := make(map[string]bool)
+	var images []Image
+	for _, link := range links {
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+
+		ok, err := access.can(link, PermissionDownload)
+		if err != nil {
+			log.Printf("Error: unable to check image access: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil, false
+		}
+		if !ok {
+			http.Error(w, "Invalid image name: "+link, http.StatusNotFound)
+			return nil, false
+		}
+		found, err := access.find(link)
+		if err != nil {
+			log.Printf("Error: unable get image list: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil, false
+		}
+		img := Image{Name: path.Base(link), Link: link}
+		if found != nil {
+			img = *found
+		}
+		images = append(images, img)
+	}
+	return images, true
+}
+
+// selectImages : 自己的圖片，可依名稱篩選或只取最新版本
+func selectImages(db *sql.DB, account, name string, latest bool) ([]Image, error) {
+	list, err := listImages(db, account)
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	newest := make(map[string]int)
+	for _, img := range list {
+		if name != "" && img.Name != name {
+			continue
+		}
+		if !latest {
+			images = append(images, img)
+			continue
+		}
+		i, ok := newest[img.Name]
+		if !ok {
+			newest[img.Name] = len(images)
+			images = append(images, img)
+			continue
+		}
+		if imageVersion(img) > imageVersion(images[i]) {
+			images[i] = img
+		}
+	}
+	return images, nil
+}
+
+// imageVersion :
+func imageVersion(img Image) int {
+	v, _ := strconv.Atoi(img.Version)
+	return v
+}
+
+// zipEntries : 以上傳時的檔名作為 ZIP 內的檔名，重複時加上 " (2)" 等編號
+func zipEntries(images []Image) []cloudstorage.ZipEntry {
+	used := make(map[string]bool)
+	entries := make([]cloudstorage.ZipEntry, 0, len(images))
+	for _, img := range images {
+		name, err := cloudstorage.SanitizeName(img.Name)
+		if err != nil {
+			name = path.Base(img.Link)
+		}
+		base, ext := cloudstorage.SplitExt(name)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		entries = append(entries, cloudstorage.ZipEntry{Object: img.Link, Name: name})
+	}
+	return entries
+}
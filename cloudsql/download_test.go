@@ -0,0 +1,40 @@
+package cloudsql
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelectLinksListsEachOwnerOnce(t *testing.T) {
+	store, _ := setupTest(t)
+	alice, bob := store.addMember("alice"), store.addMember("bob")
+	var links []string
+	for _, v := range []string{"1", "2", "3"} {
+		links = append(links, store.addImage("alice", "cat.jpg", v).Link)
+	}
+	links = append(links, store.addImage("bob", "dog.jpg", "1").Link)
+	if rec := callHandler(t, shareImage, alice, http.MethodPost, "/api/share", ShareRequest{Name: "cat.jpg", Account: "bob", Permission: PermissionDownload}); rec.Code != http.StatusOK {
+		t.Fatalf("share status = %d: %s", rec.Code, rec.Body)
+	}
+
+	store.listCalls = 0
+	rec := httptest.NewRecorder()
+	images, ok := selectLinks(rec, getDB(), bob.account, bob.mid, links)
+	if !ok {
+		t.Fatalf("selectLinks status = %d: %s", rec.Code, rec.Body)
+	}
+	if len(images) != len(links) || images[0].Name != "cat.jpg" || images[3].Name != "dog.jpg" {
+		t.Errorf("images = %+v", images)
+	}
+	if store.listCalls != 2 {
+		t.Errorf("ListImage called %d times, want once per owner", store.listCalls)
+	}
+
+	// 沒有分享的圖片
+	other := store.addImage("alice", "bird.jpg", "1")
+	rec = httptest.NewRecorder()
+	if _, ok := selectLinks(rec, getDB(), bob.account, bob.mid, []string{links[0], other.Link}); ok || rec.Code != http.StatusNotFound {
+		t.Errorf("selectLinks with an unshared image = %v, status %d, want 404", ok, rec.Code)
+	}
+}
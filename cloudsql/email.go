@@ -0,0 +1,192 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudmail"
+)
+
+// passwordResetTTL 重設密碼連結有效期限
+const passwordResetTTL = time.Hour
+
+var (
+	baseURL = "http://localhost:8080"
+
+	errEmailNotVerified = errors.New("email not verified")
+)
+
+// SetBaseURL : 設定郵件內連結使用的網址
+func SetBaseURL(u string) {
+	baseURL = strings.TrimRight(u, "/")
+}
+
+type EmailRequest struct {
+	Account string `json:"account"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// sendVerification : 寄出 Email 驗證連結
+func sendVerification(ctx context.Context, mid int, account, username, email string) error {
+	token, err := cloudkey.CreatePurposeToken(mid, account, username, cloudkey.PurposeVerify, cloudkey.VerifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/api/verify?token=%s", baseURL, url.QueryEscape(token))
+	return cloudmail.Send(ctx, cloudmail.Message{
+		To:      email,
+		Subject: "Verify your image2cloud account",
+		Body:    fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening the link below within 24 hours:\n\n%s\n", username, link),
+	})
+}
+
+// verifyEmail : 驗證連結
+func verifyEmail(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	claims, err := cloudkey.ValidatePurposeToken(r.FormValue("token"), cloudkey.PurposeVerify)
+	if err != nil {
+		log.Printf("Error: invalid verify token: %v", err)
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	verify := "UPDATE Members SET emailVerified = 1 WHERE mid = @mid AND account = @account"
+	if _, err := db.Exec(verify, sql.Named("mid", claims.UID), sql.Named("account", claims.Account)); err != nil {
+		log.Printf("Error: unable to verify email: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// validEmail : 只接受不含顯示名稱的單一地址
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// resendVerification : 重新寄出驗證連結；不論帳號是否存在都回傳 202，避免被用來查詢帳號
+func resendVerification(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	if !limitMail(w, r, req.Account) {
+		return
+	}
+
+	var (
+		mid             int
+		username, email string
+	)
+	findMember := "SELECT mid, username, email FROM Members WHERE account = @account AND emailVerified = 0 AND email IS NOT NULL"
+	err := db.QueryRow(findMember, sql.Named("account", req.Account)).Scan(&mid, &username, &email)
+	if err == nil {
+		err = sendVerification(r.Context(), mid, req.Account, username, email)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error: unable to resend verification: %v", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// forgotPassword : 寄出一次性的重設密碼連結；不論帳號是否存在都回傳 202
+func forgotPassword(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	if !limitMail(w, r, req.Account) {
+		return
+	}
+	if err := sendPasswordReset(r.Context(), db, req.Account); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error: unable to send password reset: %v", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset :
+func sendPasswordReset(ctx context.Context, db *sql.DB, account string) error {
+	var (
+		mid             int
+		username, email string
+	)
+	findMember := "SELECT mid, username, email FROM Members WHERE account = @account AND emailVerified = 1 AND email IS NOT NULL"
+	if err := db.QueryRow(findMember, sql.Named("account", account)).Scan(&mid, &username, &email); err != nil {
+		return err
+	}
+
+	token, hash, err := cloudkey.NewRefreshToken()
+	if err != nil {
+		return err
+	}
+	addReset := "INSERT INTO PasswordResets (tokenHash, mid, expiresAt) VALUES (@hash, @mid, @expiresAt)"
+	if _, err := db.Exec(addReset, sql.Named("hash", hash), sql.Named("mid", mid), sql.Named("expiresAt", time.Now().UTC().Add(passwordResetTTL))); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/?resetToken=%s", baseURL, url.QueryEscape(token))
+	return cloudmail.Send(ctx, cloudmail.Message{
+		To:      email,
+		Subject: "Reset your image2cloud password",
+		Body:    fmt.Sprintf("Hi %s,\n\nOpen the link below within one hour to choose a new password:\n\n%s\n\nIf you did not request this, you can ignore this email.\n", username, link),
+	})
+}
+
+// resetPassword : 以重設密碼連結的 Token 設定新密碼，並登出所有裝置
+func resetPassword(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		mid     int
+		account string
+	)
+	// 以條件更新讓 Token 只能使用一次
+	useReset := `UPDATE p SET usedAt = SYSUTCDATETIME()
+		OUTPUT inserted.mid, m.account
+		FROM PasswordResets p JOIN Members m ON m.mid = p.mid
+		WHERE p.tokenHash = @hash AND p.usedAt IS NULL AND p.expiresAt > SYSUTCDATETIME()`
+	err := db.QueryRow(useReset, sql.Named("hash", cloudkey.HashToken(req.Token))).Scan(&mid, &account)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to use password reset: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setPassword(db, mid, req.Password); err != nil {
+		log.Printf("Error: unable to reset password: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeMemberTokens(db, mid); err != nil {
+		log.Printf("Error: unable to revoke tokens: %v", err)
+	}
+	if loginLimiter != nil {
+		if err := loginLimiter.Success(r.Context(), account); err != nil {
+			log.Printf("Error: unable to reset login attempts: %v", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
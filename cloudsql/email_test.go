@@ -0,0 +1,172 @@
+package cloudsql
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudmail"
+)
+
+// mailToken : 從最後一封郵件的連結取出 Token
+func mailToken(t *testing.T, mailer *cloudmail.CaptureMailer, param string) string {
+	t.Helper()
+	messages := mailer.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no mail was sent")
+	}
+	m := regexp.MustCompile(`[?&]` + param + `=(\S+)`).FindStringSubmatch(messages[len(messages)-1].Body)
+	if m == nil {
+		t.Fatalf("mail has no %s link: %s", param, messages[len(messages)-1].Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifyEmail(t *testing.T) {
+	store, mailer := setupTest(t)
+	if rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: "dave", Username: "Dave", Email: "dave@example.com", Password: "pw"}); rec.Code != http.StatusOK {
+		t.Fatalf("signUp status = %d", rec.Code)
+	}
+	if to := mailer.Messages()[0].To; to != "dave@example.com" {
+		t.Errorf("verification sent to %q", to)
+	}
+	token := mailToken(t, mailer, "token")
+	m := store.member("dave")
+
+	// 過期的連結
+	expired, err := cloudkey.CreatePurposeToken(m.mid, "dave", "Dave", cloudkey.PurposeVerify, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := callAPI(t, http.MethodGet, "/api/verify?token="+url.QueryEscape(expired), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expired verify status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	// 其他用途的 Token 不能用來驗證
+	mfaToken, err := cloudkey.CreateMFAToken(m.mid, "dave", "Dave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := callAPI(t, http.MethodGet, "/api/verify?token="+url.QueryEscape(mfaToken), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("mfa token verify status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if m.emailVerified {
+		t.Fatal("email verified by an invalid token")
+	}
+
+	if rec := callAPI(t, http.MethodGet, "/api/verify?token="+url.QueryEscape(token), nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("verify status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if !m.emailVerified {
+		t.Fatal("email was not verified")
+	}
+	if resp := decodeLogin(t, callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "dave", Password: "pw"})); resp.AccessToken == "" {
+		t.Error("login after verification failed")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	store, mailer := setupTest(t)
+	if rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: "erin", Username: "Erin", Email: "erin@example.com", Password: "old password"}); rec.Code != http.StatusOK {
+		t.Fatalf("signUp status = %d", rec.Code)
+	}
+	m := store.member("erin")
+	m.emailVerified = true
+	session := decodeLogin(t, callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "erin", Password: "old password"}))
+
+	// 不存在的帳號也回傳 202，且不寄信
+	sent := len(mailer.Messages())
+	if rec := callAPI(t, http.MethodPost, "/api/password/forgot", EmailRequest{Account: "nobody"}); rec.Code != http.StatusAccepted {
+		t.Errorf("forgot for unknown account status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if len(mailer.Messages()) != sent {
+		t.Error("mail sent for an unknown account")
+	}
+
+	if rec := callAPI(t, http.MethodPost, "/api/password/forgot", EmailRequest{Account: "erin"}); rec.Code != http.StatusAccepted {
+		t.Fatalf("forgot status = %d", rec.Code)
+	}
+	token := mailToken(t, mailer, "resetToken")
+
+	if rec := callAPI(t, http.MethodPost, "/api/password/reset", ResetPasswordRequest{Token: token, Password: "new password"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("reset status = %d: %s", rec.Code, rec.Body)
+	}
+	// 重設連結只能使用一次
+	if rec := callAPI(t, http.MethodPost, "/api/password/reset", ResetPasswordRequest{Token: token, Password: "another"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused reset token status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if resp := decodeLogin(t, callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "erin", Password: "old password"})); resp.AccessToken != "" {
+		t.Error("old password still works")
+	}
+	if resp := decodeLogin(t, callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "erin", Password: "new password"})); resp.AccessToken == "" {
+		t.Error("new password does not work")
+	}
+	// 重設後其他裝置的 Refresh Token 失效
+	if rec := callAPI(t, http.MethodPost, "/api/token/refresh", RefreshRequest{RefreshToken: session.RefreshToken}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after reset status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// 過期的重設連結
+	if rec := callAPI(t, http.MethodPost, "/api/password/forgot", EmailRequest{Account: "erin"}); rec.Code != http.StatusAccepted {
+		t.Fatalf("forgot status = %d", rec.Code)
+	}
+	expired := mailToken(t, mailer, "resetToken")
+	reset := store.resets[cloudkey.HashToken(expired)]
+	if reset == nil {
+		t.Fatal("reset token was not stored")
+	}
+	if d := time.Until(reset.expiresAt); d <= 0 || d > passwordResetTTL {
+		t.Errorf("reset token expires in %v, want within %v", d, passwordResetTTL)
+	}
+	reset.expiresAt = time.Now().UTC().Add(-time.Minute)
+	if rec := callAPI(t, http.MethodPost, "/api/password/reset", ResetPasswordRequest{Token: expired, Password: "expired"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expired reset token status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMailRequestsAreThrottled(t *testing.T) {
+	store, mailer := setupTest(t)
+	mailLimiter = cloudkey.NewMailLimiter(cloudkey.NewMemoryBucketStore(), cloudkey.MailPolicy{Messages: 2, Per: time.Hour}, cloudkey.MailPolicy{Messages: 3, Per: time.Hour})
+	if rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: "frank", Username: "Frank", Email: "frank@example.com", Password: "pw"}); rec.Code != http.StatusOK {
+		t.Fatalf("signUp status = %d", rec.Code)
+	}
+	store.member("frank").emailVerified = true
+	sent := len(mailer.Messages())
+
+	for i := 0; i < 2; i++ {
+		if rec := callAPI(t, http.MethodPost, "/api/password/forgot", EmailRequest{Account: "frank"}); rec.Code != http.StatusAccepted {
+			t.Fatalf("forgot %d status = %d", i, rec.Code)
+		}
+	}
+	rec := callAPI(t, http.MethodPost, "/api/password/forgot", EmailRequest{Account: "frank"})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("third forgot status = %d (Retry-After %q), want %d", rec.Code, rec.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if got := len(mailer.Messages()) - sent; got != 2 {
+		t.Errorf("sent %d messages, want 2", got)
+	}
+
+	// 同一個 IP 對其他帳號 (不論是否存在) 也有上限
+	if rec := callAPI(t, http.MethodPost, "/api/verify/resend", EmailRequest{Account: "nobody"}); rec.Code != http.StatusAccepted {
+		t.Errorf("resend status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if rec := callAPI(t, http.MethodPost, "/api/verify/resend", EmailRequest{Account: "someone"}); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("resend over the IP limit status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestSignUpRejectsInvalidEmail(t *testing.T) {
+	setupTest(t)
+	for _, email := range []string{"", "no-at-sign", "@example.com", "Frank <frank@example.com>", "a@example.com, b@example.com"} {
+		rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: "frank", Username: "Frank", Email: email, Password: "pw"})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("signUp with email %q status = %d, want %d", email, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
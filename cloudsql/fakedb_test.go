@@ -0,0 +1,826 @@
+package cloudsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudmail"
+)
+
+// fakeStore : 測試用的資料庫，依 SQL 內容模擬 handler 使用的查詢，資料保存在 map 中。
+// 未列在 fakeQueries 的查詢會回傳錯誤，讓測試發現新的 SQL
+type fakeStore struct {
+	mu         sync.Mutex
+	nextMID    int
+	members    map[int]*fakeMember
+	refresh    map[string]*fakeRefresh
+	resets     map[string]*fakeReset
+	mfa        map[int]*fakeMFA
+	revoked    map[string]time.Time
+	identities map[string]int
+	attempts   map[string]*fakeAttempt
+	images     map[string][]Image
+	shares     []*fakeShare
+	usage      map[int]*fakeUsage
+	deletions  map[int]*fakeDeletion
+	links      map[int]*fakeShareLink
+	// listCalls exec ListImage 的呼叫次數
+	listCalls int
+}
+
+type fakeMember struct {
+	mid                      int
+	account, username, email string
+	password, role           string
+	keyVersion               driver.Value
+	emailVerified, disabled  bool
+	quotaBytes, quotaImages  driver.Value
+}
+
+type fakeRefresh struct {
+	mid               int
+	family            string
+	expiresAt         time.Time
+	usedAt, revokedAt driver.Value
+}
+
+type fakeReset struct {
+	mid       int
+	expiresAt time.Time
+	used      bool
+}
+
+type fakeAttempt struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil driver.Value
+}
+
+type fakeDeletion struct {
+	mid                    int
+	account, hash, status  string
+	errMsg                 driver.Value
+	requestedAt            time.Time
+	completedAt, claimedAt driver.Value
+	attempts               int
+}
+
+type fakeShareLink struct {
+	ownerMid               int
+	hash, filename         string
+	password, version      driver.Value
+	expiresAt, maxDownload driver.Value
+	downloads              int
+	revoked                bool
+}
+
+type fakeUsage struct {
+	bytes  int64
+	images int
+}
+
+type fakeShare struct {
+	id, ownerMid, granteeMid int
+	name, permission         string
+	version                  driver.Value
+}
+
+type fakeMFA struct {
+	secret      string
+	enabled     bool
+	lastCounter driver.Value
+}
+
+// newFakeStore :
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		nextMID:    1,
+		members:    make(map[int]*fakeMember),
+		refresh:    make(map[string]*fakeRefresh),
+		resets:     make(map[string]*fakeReset),
+		mfa:        make(map[int]*fakeMFA),
+		revoked:    make(map[string]time.Time),
+		identities: make(map[string]int),
+		attempts:   make(map[string]*fakeAttempt),
+		images:     make(map[string][]Image),
+		usage:      make(map[int]*fakeUsage),
+		deletions:  make(map[int]*fakeDeletion),
+		links:      make(map[int]*fakeShareLink),
+	}
+}
+
+// member : 依帳號找到會員
+func (s *fakeStore) member(account string) *fakeMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.members {
+		if m.account == account {
+			return m
+		}
+	}
+	return nil
+}
+
+// addMember : 直接建立已驗證的會員
+func (s *fakeStore) addMember(account string) *fakeMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &fakeMember{mid: s.nextMID, account: account, username: account, role: cloudkey.RoleMember, emailVerified: true}
+	s.members[m.mid] = m
+	s.nextMID++
+	return m
+}
+
+// addImage : 新增擁有者的圖片，物件路徑為 "owner/name-version"
+func (s *fakeStore) addImage(owner, name, version string) Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img := Image{Name: name, FileSize: "1", FileUnit: "KB", Created: "2024-01-01 00:00:00", Link: owner + "/" + name + "-" + version, Version: version}
+	s.images[owner] = append(s.images[owner], img)
+	return img
+}
+
+type fakeArgs map[string]driver.Value
+
+func (a fakeArgs) str(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+func (a fakeArgs) int(name string) int {
+	n, _ := a[name].(int64)
+	return int(n)
+}
+
+func (a fakeArgs) time(name string) time.Time {
+	t, _ := a[name].(time.Time)
+	return t
+}
+
+// fakeQuery : match 為 SQL 中的一段文字，run 回傳查詢結果與影響的資料列數
+type fakeQuery struct {
+	match string
+	run   func(s *fakeStore, query string, args fakeArgs) ([][]driver.Value, int64, error)
+}
+
+var fakeQueries = []fakeQuery{
+	{"INSERT INTO Members (", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, m := range s.members {
+			if m.account == a.str("account") {
+				return nil, 0, fmt.Errorf("duplicate account %q", m.account)
+			}
+		}
+		m := &fakeMember{
+			mid:           s.nextMID,
+			account:       a.str("account"),
+			username:      a.str("username"),
+			email:         a.str("email"),
+			password:      a.str("password"),
+			role:          cloudkey.RoleMember,
+			keyVersion:    a["keyVersion"],
+			emailVerified: strings.Contains(query, "@email, 1,"),
+		}
+		s.members[m.mid] = m
+		s.nextMID++
+		return [][]driver.Value{{int64(m.mid)}}, 1, nil
+	}},
+	{"SELECT mid, username, userpassword, macKeyVersion, emailVerified, disabled FROM Members WHERE account = @account", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, m := range s.members {
+			if m.account == a.str("account") {
+				return [][]driver.Value{{int64(m.mid), m.username, m.password, m.keyVersion, m.emailVerified, m.disabled}}, 0, nil
+			}
+		}
+		return nil, 0, nil
+	}},
+	{"UPDATE Members SET userpassword = @password, macKeyVersion = @version WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.members[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		m.password, m.keyVersion = a.str("password"), a["version"]
+		return nil, 1, nil
+	}},
+	{"UPDATE Members SET emailVerified = 1 WHERE mid = @mid AND account = @account", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.members[a.int("mid")]
+		if !ok || m.account != a.str("account") {
+			return nil, 0, nil
+		}
+		m.emailVerified = true
+		return nil, 1, nil
+	}},
+	{"SELECT mid, username, email FROM Members WHERE account = @account AND emailVerified = ", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		verified := strings.Contains(query, "emailVerified = 1")
+		for _, m := range s.members {
+			if m.account == a.str("account") && m.emailVerified == verified && m.email != "" {
+				return [][]driver.Value{{int64(m.mid), m.username, m.email}}, 0, nil
+			}
+		}
+		return nil, 0, nil
+	}},
+	{"SELECT mid, account, username FROM Members WHERE email = @email AND emailVerified = 1", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, m := range s.members {
+			if m.email == a.str("email") && m.emailVerified {
+				return [][]driver.Value{{int64(m.mid), m.account, m.username}}, 0, nil
+			}
+		}
+		return nil, 0, nil
+	}},
+	{"SELECT account, username, role, disabled FROM Members WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.members[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{m.account, m.username, m.role, m.disabled}}, 0, nil
+	}},
+	{"INSERT INTO RefreshTokens (mid, family, tokenHash, expiresAt)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		s.refresh[a.str("hash")] = &fakeRefresh{mid: a.int("mid"), family: a.str("family"), expiresAt: a.time("expiresAt")}
+		return nil, 1, nil
+	}},
+	{"SELECT mid, family, expiresAt, usedAt, revokedAt FROM RefreshTokens WHERE tokenHash = @hash", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		t, ok := s.refresh[a.str("hash")]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{int64(t.mid), t.family, t.expiresAt, t.usedAt, t.revokedAt}}, 0, nil
+	}},
+	{"UPDATE RefreshTokens SET usedAt = SYSUTCDATETIME() WHERE tokenHash = @hash", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		t, ok := s.refresh[a.str("hash")]
+		if !ok || t.usedAt != nil || t.revokedAt != nil {
+			return nil, 0, nil
+		}
+		t.usedAt = time.Now().UTC()
+		return nil, 1, nil
+	}},
+	{"UPDATE RefreshTokens SET revokedAt = SYSUTCDATETIME() WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		var n int64
+		for _, t := range s.refresh {
+			if t.mid == a.int("mid") && t.revokedAt == nil {
+				t.revokedAt = time.Now().UTC()
+				n++
+			}
+		}
+		return nil, n, nil
+	}},
+	{"INSERT INTO PasswordResets (tokenHash, mid, expiresAt)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		s.resets[a.str("hash")] = &fakeReset{mid: a.int("mid"), expiresAt: a.time("expiresAt")}
+		return nil, 1, nil
+	}},
+	{"FROM PasswordResets p JOIN Members m ON m.mid = p.mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		r, ok := s.resets[a.str("hash")]
+		if !ok || r.used || !r.expiresAt.After(time.Now().UTC()) {
+			return nil, 0, nil
+		}
+		r.used = true
+		return [][]driver.Value{{int64(r.mid), s.members[r.mid].account}}, 1, nil
+	}},
+	{"SELECT enabled FROM MemberMFA WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.mfa[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{m.enabled}}, 0, nil
+	}},
+	{"SELECT secret, enabled, lastCounter FROM MemberMFA WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.mfa[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{m.secret, m.enabled, m.lastCounter}}, 0, nil
+	}},
+	{"UPDATE MemberMFA SET lastCounter = @counter WHERE mid = @mid AND (lastCounter IS NULL OR lastCounter < @counter)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.mfa[a.int("mid")]
+		counter, _ := a["counter"].(int64)
+		if !ok {
+			return nil, 0, nil
+		}
+		if last, ok := m.lastCounter.(int64); ok && last >= counter {
+			return nil, 0, nil
+		}
+		m.lastCounter = counter
+		return nil, 1, nil
+	}},
+	{"DELETE FROM RevokedTokens WHERE expiresAt < SYSUTCDATETIME()", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		var n int64
+		for jti, exp := range s.revoked {
+			if exp.Before(time.Now().UTC()) {
+				delete(s.revoked, jti)
+				n++
+			}
+		}
+		return nil, n, nil
+	}},
+	{"INSERT INTO RevokedTokens (jti, expiresAt)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		if _, ok := s.revoked[a.str("jti")]; ok {
+			return nil, 0, nil
+		}
+		s.revoked[a.str("jti")] = a.time("expiresAt")
+		return nil, 1, nil
+	}},
+	{"SELECT count(*) FROM RevokedTokens WHERE jti = @jti", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		if _, ok := s.revoked[a.str("jti")]; ok {
+			return [][]driver.Value{{int64(1)}}, 0, nil
+		}
+		return [][]driver.Value{{int64(0)}}, 0, nil
+	}},
+	{"FROM MemberIdentities i JOIN Members m ON m.mid = i.mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		mid, ok := s.identities[a.str("provider")+"\x00"+a.str("subject")]
+		if !ok {
+			return nil, 0, nil
+		}
+		m := s.members[mid]
+		return [][]driver.Value{{int64(m.mid), m.account, m.username}}, 0, nil
+	}},
+	{"INSERT INTO MemberIdentities (provider, subject, mid, email)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		s.identities[a.str("provider")+"\x00"+a.str("subject")] = a.int("mid")
+		return nil, 1, nil
+	}},
+	{"exec ListImage @account", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		s.listCalls++
+		var rows [][]driver.Value
+		for _, img := range s.images[a.str("account")] {
+			rows = append(rows, []driver.Value{img.Name, img.FileSize, img.FileUnit, img.Created, img.Link, img.Version})
+		}
+		return rows, 0, nil
+	}},
+	{"exec dbo.DownloadImage @account, @filename", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, img := range s.images[a.str("account")] {
+			if img.Link == a.str("filename") {
+				return [][]driver.Value{{int64(1)}}, 0, nil
+			}
+		}
+		return [][]driver.Value{{int64(0)}}, 0, nil
+	}},
+	{"SELECT mid FROM Members WHERE account = @account AND disabled = 0", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, m := range s.members {
+			if m.account == a.str("account") && !m.disabled {
+				return [][]driver.Value{{int64(m.mid)}}, 0, nil
+			}
+		}
+		return nil, 0, nil
+	}},
+	{"MERGE ImageShares WITH (HOLDLOCK)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, sh := range s.shares {
+			if sh.ownerMid == a.int("owner") && sh.granteeMid == a.int("grantee") && sh.name == a.str("name") && sh.version == a["version"] {
+				sh.permission = a.str("permission")
+				return [][]driver.Value{{int64(sh.id)}}, 1, nil
+			}
+		}
+		sh := &fakeShare{id: len(s.shares) + 1, ownerMid: a.int("owner"), granteeMid: a.int("grantee"), name: a.str("name"), version: a["version"], permission: a.str("permission")}
+		s.shares = append(s.shares, sh)
+		return [][]driver.Value{{int64(sh.id)}}, 1, nil
+	}},
+	{"SELECT s.permission FROM ImageShares s JOIN Members m ON m.mid = s.ownerMid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		var rows [][]driver.Value
+		for _, sh := range s.shares {
+			owner := s.members[sh.ownerMid]
+			if owner.account != a.str("owner") || owner.disabled || sh.granteeMid != a.int("mid") || sh.name != a.str("name") {
+				continue
+			}
+			if sh.version == nil || sh.version == a["version"] {
+				rows = append(rows, []driver.Value{sh.permission})
+			}
+		}
+		return rows, 0, nil
+	}},
+	{"INSERT INTO ShareLinks (ownerMid, tokenHash, filename, passwordHash, passwordKeyVersion, expiresAt, maxDownloads, createdTime)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		id := len(s.links) + 1
+		s.links[id] = &fakeShareLink{
+			ownerMid:    a.int("mid"),
+			hash:        a.str("hash"),
+			filename:    a.str("filename"),
+			password:    a["password"],
+			version:     a["version"],
+			expiresAt:   a["expiresAt"],
+			maxDownload: a["maxDownloads"],
+		}
+		return [][]driver.Value{{int64(id)}}, 1, nil
+	}},
+	{"FROM ShareLinks l JOIN Members m ON m.mid = l.ownerMid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for id, l := range s.links {
+			if l.hash != a.str("hash") || l.revoked || s.members[l.ownerMid].disabled {
+				continue
+			}
+			if exp, ok := l.expiresAt.(time.Time); ok && !exp.After(time.Now().UTC()) {
+				continue
+			}
+			if max, ok := l.maxDownload.(int64); ok && int64(l.downloads) >= max {
+				continue
+			}
+			return [][]driver.Value{{int64(id), l.filename, l.password, l.version}}, 0, nil
+		}
+		return nil, 0, nil
+	}},
+	{"UPDATE ShareLinks SET downloads = downloads + 1", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		l, ok := s.links[a.int("id")]
+		if !ok || l.revoked {
+			return nil, 0, nil
+		}
+		if max, ok := l.maxDownload.(int64); ok && int64(l.downloads) >= max {
+			return nil, 0, nil
+		}
+		l.downloads++
+		return nil, 1, nil
+	}},
+	{"UPDATE ShareLinks SET revokedAt = SYSUTCDATETIME() WHERE id = @id AND ownerMid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		l, ok := s.links[a.int("id")]
+		if !ok || l.ownerMid != a.int("mid") || l.revoked {
+			return nil, 0, nil
+		}
+		l.revoked = true
+		return nil, 1, nil
+	}},
+	{"SELECT userpassword FROM Members WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		m, ok := s.members[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{m.password}}, 0, nil
+	}},
+	{"INSERT INTO AccountDeletions (mid, account, tokenHash, status, requestedAt)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		if m, ok := s.members[a.int("mid")]; ok {
+			m.disabled = true
+		}
+		id := len(s.deletions) + 1
+		s.deletions[id] = &fakeDeletion{mid: a.int("mid"), account: a.str("account"), hash: a.str("hash"), status: a.str("status"), requestedAt: a.time("requestedAt")}
+		return [][]driver.Value{{int64(id)}}, 1, nil
+	}},
+	{"SELECT status, error, requestedAt, completedAt, attempts FROM AccountDeletions WHERE tokenHash = @hash", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		for _, d := range s.deletions {
+			if d.hash == a.str("hash") {
+				return [][]driver.Value{{d.status, d.errMsg, d.requestedAt, d.completedAt, int64(d.attempts)}}, 0, nil
+			}
+		}
+		return nil, 0, nil
+	}},
+	{"SELECT id, mid, account FROM AccountDeletions WHERE status <> @done AND attempts < @maxAttempts", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		var rows [][]driver.Value
+		for id := 1; id <= len(s.deletions); id++ {
+			if d := s.deletions[id]; d.status != a.str("done") && d.attempts < a.int("maxAttempts") {
+				rows = append(rows, []driver.Value{int64(id), int64(d.mid), d.account})
+			}
+		}
+		return rows, 0, nil
+	}},
+	{"UPDATE AccountDeletions SET status = @running, claimedAt = SYSUTCDATETIME(), attempts = attempts + 1", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		d, ok := s.deletions[a.int("id")]
+		if !ok || d.status == DeletionDone || d.attempts >= a.int("maxAttempts") {
+			return nil, 0, nil
+		}
+		if claimed, ok := d.claimedAt.(time.Time); ok && !claimed.Before(a.time("stale")) {
+			return nil, 0, nil
+		}
+		d.status, d.claimedAt = a.str("running"), time.Now().UTC()
+		d.attempts++
+		return nil, 1, nil
+	}},
+	{"UPDATE AccountDeletions SET status = @status, error = @error, claimedAt = NULL", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		d, ok := s.deletions[a.int("id")]
+		if !ok {
+			return nil, 0, nil
+		}
+		d.status, d.errMsg, d.claimedAt = a.str("status"), a["error"], nil
+		if d.status == DeletionDone {
+			d.completedAt = time.Now().UTC()
+		}
+		return nil, 1, nil
+	}},
+	{"DELETE FROM Members WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		mid := a.int("mid")
+		m, ok := s.members[mid]
+		if !ok {
+			return nil, 0, nil
+		}
+		for hash, t := range s.refresh {
+			if t.mid == mid {
+				delete(s.refresh, hash)
+			}
+		}
+		shares := s.shares[:0]
+		for _, sh := range s.shares {
+			if sh.ownerMid != mid && sh.granteeMid != mid {
+				shares = append(shares, sh)
+			}
+		}
+		s.shares = shares
+		for key, id := range s.identities {
+			if id == mid {
+				delete(s.identities, key)
+			}
+		}
+		delete(s.mfa, mid)
+		delete(s.attempts, a.str("attemptKey"))
+		delete(s.usage, mid)
+		delete(s.images, m.account)
+		delete(s.members, mid)
+		return nil, 1, nil
+	}},
+	{"SELECT 1 FROM StorageUsage WHERE mid = @mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		if _, ok := s.usage[a.int("mid")]; !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{int64(1)}}, 0, nil
+	}},
+	{"UPDATE u SET bytes = u.bytes + @bytes, images = u.images + @images", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		u, ok := s.usage[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		m := s.members[a.int("mid")]
+		maxBytes, maxImages := a["defaultBytes"].(int64), int64(a.int("defaultImages"))
+		if m.quotaBytes != nil {
+			maxBytes = m.quotaBytes.(int64)
+		}
+		if m.quotaImages != nil {
+			maxImages = m.quotaImages.(int64)
+		}
+		bytes, images := u.bytes+a["bytes"].(int64), u.images+a.int("images")
+		if (maxBytes > 0 && bytes > maxBytes) || (maxImages > 0 && int64(images) > maxImages) {
+			return nil, 0, nil
+		}
+		u.bytes, u.images = bytes, images
+		return nil, 1, nil
+	}},
+	{"UPDATE StorageUsage SET bytes = CASE WHEN bytes > @bytes", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		u, ok := s.usage[a.int("mid")]
+		if !ok {
+			return nil, 0, nil
+		}
+		u.bytes -= a["bytes"].(int64)
+		u.images -= a.int("images")
+		if u.bytes < 0 {
+			u.bytes = 0
+		}
+		if u.images < 0 {
+			u.images = 0
+		}
+		return nil, 1, nil
+	}},
+	{"FROM Members m LEFT JOIN StorageUsage u ON u.mid = m.mid", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		var rows [][]driver.Value
+		for mid := 1; mid < s.nextMID; mid++ {
+			m, ok := s.members[mid]
+			if !ok || (a.str("account") != "" && m.account != a.str("account")) {
+				continue
+			}
+			row := []driver.Value{int64(m.mid), m.account, nil, nil, m.quotaBytes, m.quotaImages}
+			if u, ok := s.usage[m.mid]; ok {
+				row[2], row[3] = u.bytes, int64(u.images)
+			}
+			rows = append(rows, row)
+		}
+		return rows, 0, nil
+	}},
+	{"SELECT failures, lockedUntil FROM LoginAttempts WHERE attemptKey = @key", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		at, ok := s.attempts[a.str("key")]
+		if !ok {
+			return nil, 0, nil
+		}
+		return [][]driver.Value{{int64(at.failures), at.lockedUntil}}, 0, nil
+	}},
+	{"MERGE LoginAttempts WITH (HOLDLOCK)", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		at, ok := s.attempts[a.str("key")]
+		if !ok {
+			at = &fakeAttempt{}
+			s.attempts[a.str("key")] = at
+		}
+		if at.lastFailure.Before(a.time("windowStart")) {
+			at.failures = 0
+		}
+		at.failures++
+		at.lastFailure = a.time("now")
+		return [][]driver.Value{{int64(at.failures)}}, 1, nil
+	}},
+	{"UPDATE LoginAttempts SET lockedUntil = @until WHERE attemptKey = @key", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		at, ok := s.attempts[a.str("key")]
+		if !ok {
+			return nil, 0, nil
+		}
+		at.lockedUntil = a.time("until")
+		return nil, 1, nil
+	}},
+	{"DELETE FROM LoginAttempts WHERE attemptKey = @key", func(s *fakeStore, query string, a fakeArgs) ([][]driver.Value, int64, error) {
+		if _, ok := s.attempts[a.str("key")]; !ok {
+			return nil, 0, nil
+		}
+		delete(s.attempts, a.str("key"))
+		return nil, 1, nil
+	}},
+}
+
+// run : 依 SQL 找到對應的 fakeQuery 並執行
+func (s *fakeStore) run(query string, named []driver.NamedValue) ([][]driver.Value, int64, error) {
+	args := make(fakeArgs, len(named))
+	for _, nv := range named {
+		args[nv.Name] = nv.Value
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range fakeQueries {
+		if strings.Contains(query, q.match) {
+			return q.run(s, query, args)
+		}
+	}
+	return nil, 0, fmt.Errorf("fakeStore: unexpected query: %s", query)
+}
+
+// fakeConnector : 以 sql.OpenDB 使用 fakeStore
+type fakeConnector struct{ store *fakeStore }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("fakeDriver: use fakeConnector")
+}
+
+type fakeConn struct{ store *fakeStore }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakeConn: prepared statements are not supported")
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+func (c fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+// CheckNamedValue : 接受所有參數型別，保留 sql.Named 的名稱
+func (c fakeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, ok := nv.Value.(driver.Valuer); ok {
+		value, err := v.Value()
+		if err != nil {
+			return err
+		}
+		nv.Value = value
+	}
+	if n, ok := nv.Value.(int); ok {
+		nv.Value = int64(n)
+	}
+	return nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, n, err := c.store.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+// QueryContext : fakeRows 只有一個結果集，含多個 OUTPUT 的批次在 SQL Server 上會回傳多個結果集，
+// QueryRow 只會讀到第一個 (可能是空的)，因此直接回傳錯誤
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.Count(query, "OUTPUT ") > 1 || (strings.Contains(query, "OUTPUT ") && strings.Contains(query, "@@ROWCOUNT")) {
+		return nil, fmt.Errorf("fakeConn: query returns more than one result set: %s", query)
+	}
+	rows, _, err := c.store.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+// fakeTx : 不支援 Rollback，測試只驗證成功的流程
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	rows [][]driver.Value
+	i    int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = fmt.Sprintf("c%d", i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+
+// setupTest : 以 fakeStore 取代資料庫，並設定本機的簽章金鑰、MAC 金鑰與 CaptureMailer
+func setupTest(t *testing.T) (*fakeStore, *cloudmail.CaptureMailer) {
+	t.Helper()
+	store := newFakeStore()
+	once.Do(func() {})
+	db = sql.OpenDB(fakeConnector{store})
+
+	ks := &cloudkey.KeySet{
+		Active: "test",
+		Keys:   []cloudkey.SigningKey{{ID: "test", Alg: cloudkey.AlgHS256, Secret: bytes.Repeat([]byte("k"), 32)}},
+	}
+	if err := cloudkey.SetKeySet(context.Background(), ks); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "mac.key")
+	if err := os.WriteFile(path, []byte("1:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("m"), 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := cloudkey.NewLocalMacSigner(path, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloudkey.SetMacSigner(signer, "1")
+	cloudkey.SetPasswordHashing(cloudkey.PasswordParams{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}, true)
+	cloudkey.SetRevocationChecker(TokenRevocation{})
+	mailer := cloudmail.NewCaptureMailer()
+	cloudmail.Set(mailer)
+
+	limiter, mails := loginLimiter, mailLimiter
+	loginLimiter, mailLimiter = nil, nil
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+		loginLimiter, mailLimiter = limiter, mails
+		cloudkey.SetRevocationChecker(nil)
+		cloudkey.SetPasswordHashing(cloudkey.DefaultPasswordParams, true)
+		cloudmail.Set(nil)
+	})
+	return store, mailer
+}
+
+// callAPI : 以 JSON body 呼叫 API
+func callAPI(t *testing.T, method, target string, body interface{}, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	API(rec, req)
+	return rec
+}
+
+// callHandler : 以會員的身分直接呼叫 handler，略過 Token 驗證
+func callHandler(t *testing.T, f func(http.ResponseWriter, *http.Request, *sql.DB), m *fakeMember, method, target string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if m != nil {
+		p := &cloudkey.Principal{UID: m.mid, Account: m.account, Username: m.username, Role: m.role, Scopes: cloudkey.RoleScopes(m.role)}
+		req = req.WithContext(cloudkey.WithPrincipal(req.Context(), p))
+	}
+	rec := httptest.NewRecorder()
+	f(rec, req, getDB())
+	return rec
+}
+
+// decodeLogin :
+func decodeLogin(t *testing.T, rec *httptest.ResponseRecorder) LoginResponse {
+	t.Helper()
+	var resp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode login response: %v (status %d)", err, rec.Code)
+	}
+	return resp
+}
@@ -0,0 +1,202 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+var loginLimiter *cloudkey.LoginLimiter
+
+// SetLoginLimiter : 設定登入失敗的追蹤方式，未設定時不限制
+func SetLoginLimiter(l *cloudkey.LoginLimiter) {
+	loginLimiter = l
+}
+
+// trustedProxies 可信任的反向代理，只有來自這些位址的請求才採用 X-Forwarded-For
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies : 設定可信任的反向代理 (CIDR)，未設定時一律使用連線來源
+func SetTrustedProxies(cidrs []string) error {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		// 信任所有位址時任何 X-Forwarded-For 都會被略過，所有人共用同一個 IP 鎖定
+		if ones, _ := n.Mask.Size(); ones == 0 {
+			return fmt.Errorf("invalid trusted proxy %q: use a proxy hop count instead", cidr)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// proxyHops 請求固定經過的反向代理層數，大於 0 時優先於 trustedProxies
+var proxyHops int
+
+// SetProxyHops : 設定請求固定經過的反向代理層數，由 X-Forwarded-For 的最後往前取第 n 個位址。
+// Cloud Run 由 Google 前端將用戶端位址附加在最後，設為 1；前面再經過外部負載平衡器時設為 2
+func SetProxyHops(n int) {
+	proxyHops = n
+}
+
+// trustedProxy :
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP : 設定代理層數時取 X-Forwarded-For 最後往前第 proxyHops 個位址；
+// 否則連線來源為可信任的代理時，由最後往前取第一個非代理的位址
+// (代理會將連線來源附加在最後，前面的內容可由用戶端偽造)
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if proxyHops > 0 {
+		parts := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if len(parts) >= proxyHops {
+			if ip := strings.TrimSpace(parts[len(parts)-proxyHops]); net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+		return host
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	parts := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(parts[i])
+		if ip == "" {
+			break
+		}
+		if !trustedProxy(ip) {
+			return ip
+		}
+	}
+	return host
+}
+
+// tooManyAttempts : 回傳 429 與 Retry-After
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(cloudkey.AuthError{Error: "too_many_attempts", Message: "too many failed login attempts, try again later"})
+}
+
+type UnlockRequest struct {
+	Account string `json:"account"`
+	IP      string `json:"ip"`
+}
+
+// unlockLogin : 管理者解除帳號或 IP 的登入鎖定
+func unlockLogin(w http.ResponseWriter, r *http.Request) {
+	var req UnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Account == "" && req.IP == "") {
+		http.Error(w, "account or ip is required", http.StatusBadRequest)
+		return
+	}
+	if loginLimiter == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var keys []string
+	if req.Account != "" {
+		keys = append(keys, cloudkey.AccountKey(req.Account))
+	}
+	if req.IP != "" {
+		keys = append(keys, cloudkey.IPKey(req.IP))
+	}
+	for _, key := range keys {
+		if err := loginLimiter.Unlock(r.Context(), key); err != nil {
+			log.Printf("Error: unable to unlock %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("%s unlocked %v", principal(r).Account, keys)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SQLAttemptStore : 以 LoginAttempts 資料表實作 cloudkey.AttemptStore，
+// 讓多個 Cloud Run 執行個體共用登入失敗狀態
+type SQLAttemptStore struct{}
+
+// Get :
+func (SQLAttemptStore) Get(ctx context.Context, key string) (cloudkey.Attempt, error) {
+	var (
+		a           cloudkey.Attempt
+		lockedUntil sql.NullTime
+	)
+	getAttempt := "SELECT failures, lockedUntil FROM LoginAttempts WHERE attemptKey = @key"
+	err := getDB().QueryRowContext(ctx, getAttempt, sql.Named("key", key)).Scan(&a.Failures, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cloudkey.Attempt{}, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	if lockedUntil.Valid {
+		a.LockedUntil = lockedUntil.Time
+	}
+	return a, nil
+}
+
+// Increment :
+func (SQLAttemptStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	var failures int
+	// 單一 MERGE 只回傳一個結果集；HOLDLOCK 避免同一個 key 同時新增兩筆
+	increment := `MERGE LoginAttempts WITH (HOLDLOCK) AS a
+		USING (SELECT @key AS attemptKey) AS s ON a.attemptKey = s.attemptKey
+		WHEN MATCHED THEN
+			UPDATE SET failures = CASE WHEN a.lastFailure < @windowStart THEN 1 ELSE a.failures + 1 END, lastFailure = @now
+		WHEN NOT MATCHED THEN
+			INSERT (attemptKey, failures, lastFailure) VALUES (@key, 1, @now)
+		OUTPUT inserted.failures;`
+	now := time.Now().UTC()
+	err := getDB().QueryRowContext(ctx, increment, sql.Named("key", key), sql.Named("now", now), sql.Named("windowStart", now.Add(-window))).Scan(&failures)
+	return failures, err
+}
+
+// Lock :
+func (SQLAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	lock := "UPDATE LoginAttempts SET lockedUntil = @until WHERE attemptKey = @key"
+	_, err := getDB().ExecContext(ctx, lock, sql.Named("key", key), sql.Named("until", until.UTC()))
+	return err
+}
+
+// Reset :
+func (SQLAttemptStore) Reset(ctx context.Context, key string) error {
+	reset := "DELETE FROM LoginAttempts WHERE attemptKey = @key"
+	_, err := getDB().ExecContext(ctx, reset, sql.Named("key", key))
+	return err
+}
@@ -0,0 +1,106 @@
+package cloudsql
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+func TestSQLAttemptStore(t *testing.T) {
+	store, _ := setupTest(t)
+	ctx := context.Background()
+	var s SQLAttemptStore
+
+	key := cloudkey.AccountKey("alice")
+	for want := 1; want <= 2; want++ {
+		n, err := s.Increment(ctx, key, time.Hour)
+		if err != nil {
+			t.Fatalf("Increment: %v", err)
+		}
+		if n != want {
+			t.Errorf("Increment = %d, want %d", n, want)
+		}
+	}
+
+	// 上次失敗早於 window 時重新計算
+	store.attempts[key].lastFailure = time.Now().UTC().Add(-2 * time.Hour)
+	if n, err := s.Increment(ctx, key, time.Hour); err != nil || n != 1 {
+		t.Errorf("Increment after window = %d, %v, want 1", n, err)
+	}
+
+	until := time.Now().Add(time.Minute).UTC()
+	if err := s.Lock(ctx, key, until); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	a, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if a.Failures != 1 || !a.LockedUntil.Equal(until) {
+		t.Errorf("Get = %+v, want 1 failure locked until %v", a, until)
+	}
+
+	if err := s.Reset(ctx, key); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if a, err := s.Get(ctx, key); err != nil || a.Failures != 0 {
+		t.Errorf("Get after Reset = %+v, %v, want no failures", a, err)
+	}
+}
+
+func TestLoginFailureCountsAccountAndIP(t *testing.T) {
+	store, _ := setupTest(t)
+	loginLimiter = cloudkey.NewLoginLimiter(SQLAttemptStore{}, cloudkey.DefaultAccountPolicy, cloudkey.DefaultIPPolicy)
+
+	rec := callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "nobody", Password: "wrong"})
+	if rec.Code == http.StatusInternalServerError {
+		t.Fatalf("login status = %d: %s", rec.Code, rec.Body)
+	}
+	for _, key := range []string{cloudkey.AccountKey("nobody"), cloudkey.IPKey("192.0.2.1")} {
+		if a := store.attempts[key]; a == nil || a.failures != 1 {
+			t.Errorf("attempt %s = %+v, want 1 failure", key, a)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Cleanup(func() {
+		SetProxyHops(0)
+		SetTrustedProxies(nil)
+	})
+	if err := SetTrustedProxies([]string{"0.0.0.0/0"}); err == nil {
+		t.Error("SetTrustedProxies accepted 0.0.0.0/0")
+	}
+
+	tests := []struct {
+		name    string
+		hops    int
+		proxies []string
+		xff     string
+		want    string
+	}{
+		{name: "no proxy", xff: "203.0.113.9", want: "192.0.2.1"},
+		{name: "one hop", hops: 1, xff: "198.51.100.1, 203.0.113.9", want: "203.0.113.9"},
+		{name: "two hops", hops: 2, xff: "198.51.100.1, 203.0.113.9, 192.0.2.50", want: "203.0.113.9"},
+		{name: "missing hop", hops: 2, xff: "203.0.113.9", want: "192.0.2.1"},
+		{name: "invalid entry", hops: 1, xff: "198.51.100.1, bogus", want: "192.0.2.1"},
+		{name: "trusted proxy", proxies: []string{"192.0.2.0/24"}, xff: "198.51.100.1, 203.0.113.9, 192.0.2.50", want: "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetProxyHops(tt.hops)
+			if err := SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+			r.Header.Set("X-Forwarded-For", tt.xff)
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package cloudsql
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+func TestSignUpAndLogin(t *testing.T) {
+	store, _ := setupTest(t)
+
+	signUp := LoginRequest{Account: "alice", Username: "Alice", Email: "alice@example.com", Password: "correct horse"}
+	if rec := callAPI(t, http.MethodPost, "/api/signUp", signUp); rec.Code != http.StatusOK {
+		t.Fatalf("signUp status = %d: %s", rec.Code, rec.Body)
+	}
+	m := store.member("alice")
+	if m == nil {
+		t.Fatal("member was not created")
+	}
+	if !strings.HasPrefix(m.password, "$argon2id+mac$") || m.keyVersion != "1" {
+		t.Errorf("stored password = %q (key version %v), want argon2id+mac with version 1", m.password, m.keyVersion)
+	}
+
+	login := LoginRequest{Account: "alice", Password: "correct horse"}
+	if rec := callAPI(t, http.MethodPost, "/api/login", login); rec.Code != http.StatusForbidden {
+		t.Errorf("login before verification status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	m.emailVerified = true
+
+	rec := callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "alice", Password: "wrong"})
+	if resp := decodeLogin(t, rec); resp.AccessToken != "" {
+		t.Error("login with a wrong password returned an access token")
+	}
+
+	resp := decodeLogin(t, callAPI(t, http.MethodPost, "/api/login", login))
+	if resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Fatalf("login response = %+v, want tokens", resp)
+	}
+	claims, err := cloudkey.ValidateToken(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Account != "alice" || claims.UID != m.mid || claims.Role != cloudkey.RoleMember {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// Refresh Token 只能使用一次
+	refresh := decodeLogin(t, callAPI(t, http.MethodPost, "/api/token/refresh", RefreshRequest{RefreshToken: resp.RefreshToken}))
+	if refresh.AccessToken == "" {
+		t.Fatal("refresh did not return an access token")
+	}
+	if rec := callAPI(t, http.MethodPost, "/api/token/refresh", RefreshRequest{RefreshToken: resp.RefreshToken}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginCookieSession(t *testing.T) {
+	store, _ := setupTest(t)
+	if rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: "bob", Username: "Bob", Email: "bob@example.com", Password: "pw"}); rec.Code != http.StatusOK {
+		t.Fatalf("signUp status = %d", rec.Code)
+	}
+	store.member("bob").emailVerified = true
+
+	rec := callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "bob", Password: "pw", Cookie: true})
+	resp := decodeLogin(t, rec)
+	if resp.AccessToken != "" || resp.CSRFToken == "" {
+		t.Fatalf("cookie login response = %+v, want only a csrf token", resp)
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	for _, name := range []string{cloudkey.SessionCookie, cloudkey.RefreshCookie, cloudkey.CSRFCookie} {
+		c, ok := cookies[name]
+		if !ok {
+			t.Errorf("missing cookie %s", name)
+			continue
+		}
+		if !c.Secure {
+			t.Errorf("cookie %s is not Secure", name)
+		}
+		if name != cloudkey.CSRFCookie && !c.HttpOnly {
+			t.Errorf("cookie %s is not HttpOnly", name)
+		}
+	}
+	if cookies[cloudkey.CSRFCookie] != nil && cookies[cloudkey.CSRFCookie].Value != resp.CSRFToken {
+		t.Error("csrf cookie does not match the response")
+	}
+}
+
+func TestSignUpRejectsInvalidAccount(t *testing.T) {
+	store, mailer := setupTest(t)
+	for _, account := range []string{"../bob", "a/b", "with space"} {
+		rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: account, Username: "x", Email: "x@example.com", Password: "pw"})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("signUp(%q) status = %d, want %d", account, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if len(store.members) != 0 || len(mailer.Messages()) != 0 {
+		t.Error("invalid sign ups created members or sent mail")
+	}
+}
@@ -0,0 +1,282 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// totpIssuer 顯示在驗證器 App 上的名稱
+const totpIssuer = "image2cloud"
+
+type MFARequest struct {
+	MFAToken     string `json:"mfaToken"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+	Cookie       bool   `json:"cookie"`
+}
+
+type MFAEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type MFAActivateResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// mfaEnabled : 會員是否已啟用 TOTP
+func mfaEnabled(db *sql.DB, mid int) (bool, error) {
+	var enabled bool
+	checkMFA := "SELECT enabled FROM MemberMFA WHERE mid = @mid"
+	err := db.QueryRow(checkMFA, sql.Named("mid", mid)).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// verifyMFACode : 驗證 TOTP 驗證碼或一次性備用碼。
+// 已使用過的時間區間不可重複使用，備用碼使用後即失效
+func verifyMFACode(db *sql.DB, mid int, code, recoveryCode string, requireEnabled bool) (bool, error) {
+	var (
+		secret      string
+		enabled     bool
+		lastCounter sql.NullInt64
+	)
+	findMFA := "SELECT secret, enabled, lastCounter FROM MemberMFA WHERE mid = @mid"
+	err := db.QueryRow(findMFA, sql.Named("mid", mid)).Scan(&secret, &enabled, &lastCounter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if requireEnabled && !enabled {
+		return false, nil
+	}
+
+	if recoveryCode != "" {
+		if !enabled {
+			return false, nil
+		}
+		useCode := "UPDATE MFARecoveryCodes SET usedAt = SYSUTCDATETIME() WHERE mid = @mid AND codeHash = @hash AND usedAt IS NULL"
+		res, err := db.Exec(useCode, sql.Named("mid", mid), sql.Named("hash", cloudkey.HashRecoveryCode(recoveryCode)))
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	counter, ok := cloudkey.VerifyTOTP(secret, code, time.Now())
+	if !ok || (lastCounter.Valid && counter <= lastCounter.Int64) {
+		return false, nil
+	}
+	// 以條件更新防止同一個驗證碼同時被使用兩次
+	useCounter := "UPDATE MemberMFA SET lastCounter = @counter WHERE mid = @mid AND (lastCounter IS NULL OR lastCounter < @counter)"
+	res, err := db.Exec(useCounter, sql.Named("mid", mid), sql.Named("counter", counter))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// enrollMFA : 產生新的 TOTP 密鑰，需以 activateMFA 驗證後才會啟用
+func enrollMFA(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	enabled, err := mfaEnabled(db, p.UID)
+	if err != nil {
+		log.Printf("Error: unable to check mfa: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "MFA already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := cloudkey.NewTOTPSecret()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	saveSecret := `DELETE FROM MemberMFA WHERE mid = @mid
+		INSERT INTO MemberMFA (mid, secret, enabled) VALUES (@mid, @secret, 0)`
+	if _, err := db.Exec(saveSecret, sql.Named("mid", p.UID), sql.Named("secret", secret)); err != nil {
+		log.Printf("Error: unable to save mfa secret: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAEnrollResponse{
+		Secret: secret,
+		URI:    cloudkey.TOTPURI(totpIssuer, p.Account, secret),
+	})
+}
+
+// activateMFA : 驗證第一組驗證碼後啟用 TOTP，並產生一次性備用碼
+func activateMFA(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req MFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	ok, err := verifyMFACode(db, p.UID, req.Code, "", false)
+	if err != nil {
+		log.Printf("Error: unable to verify mfa code: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := cloudkey.NewRecoveryCodes(10)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM MFARecoveryCodes WHERE mid = @mid", sql.Named("mid", p.UID)); err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, hash := range hashes {
+		addCode := "INSERT INTO MFARecoveryCodes (mid, codeHash) VALUES (@mid, @hash)"
+		if _, err := tx.Exec(addCode, sql.Named("mid", p.UID), sql.Named("hash", hash)); err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.Exec("UPDATE MemberMFA SET enabled = 1 WHERE mid = @mid", sql.Named("mid", p.UID)); err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAActivateResponse{RecoveryCodes: codes})
+}
+
+// disableMFA : 需提供目前的驗證碼或備用碼
+func disableMFA(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req MFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "code or recoveryCode is required", http.StatusBadRequest)
+		return
+	}
+	ok, err := verifyMFACode(db, p.UID, req.Code, req.RecoveryCode, true)
+	if err != nil {
+		log.Printf("Error: unable to verify mfa code: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	removeMFA := `DELETE FROM MFARecoveryCodes WHERE mid = @mid
+		DELETE FROM MemberMFA WHERE mid = @mid`
+	if _, err := db.Exec(removeMFA, sql.Named("mid", p.UID)); err != nil {
+		log.Printf("Error: unable to disable mfa: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loginMFA : 登入第二步，以 MFA Token 與驗證碼換取 Access Token
+func loginMFA(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req MFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "mfaToken and code are required", http.StatusBadRequest)
+		return
+	}
+	claims, err := cloudkey.ValidateMFAToken(req.MFAToken)
+	if err != nil {
+		cloudkey.Unauthorized(w, "invalid_token", err.Error())
+		return
+	}
+
+	keys := []string{cloudkey.AccountKey(claims.Account), cloudkey.IPKey(clientIP(r))}
+	if loginLimiter != nil {
+		wait, err := loginLimiter.Check(r.Context(), keys...)
+		if err != nil {
+			log.Printf("Error: unable to check login attempts: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+	}
+
+	ok, err := verifyMFACode(db, claims.UID, req.Code, req.RecoveryCode, true)
+	if err != nil {
+		log.Printf("Error: unable to verify mfa code: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if loginLimiter != nil {
+			if _, err := loginLimiter.Failure(r.Context(), keys...); err != nil {
+				log.Printf("Error: unable to record login failure: %v", err)
+			}
+		}
+		cloudkey.Unauthorized(w, "invalid_code", "invalid mfa code")
+		return
+	}
+
+	// MFA Token 只能使用一次
+	if err := revokeAccessToken(db, claims.Id, claims.ExpiresTime()); err != nil {
+		log.Printf("Error: unable to revoke mfa token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if loginLimiter != nil {
+		if err := loginLimiter.Success(r.Context(), claims.Account); err != nil {
+			log.Printf("Error: unable to reset login attempts: %v", err)
+		}
+	}
+
+	resp, err := issueTokens(db, claims.UID, "")
+	if errors.Is(err, errAccountDisabled) {
+		cloudkey.Forbidden(w, "account_disabled", "account disabled")
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to issue token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := writeTokens(w, resp, req.Cookie); err != nil {
+		log.Println(err.Error())
+	}
+}
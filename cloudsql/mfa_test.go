@@ -0,0 +1,75 @@
+package cloudsql
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// totpNow : 依 RFC 6238 計算目前的驗證碼，模擬驗證器 App
+func totpNow(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestLoginMFARejectsReplay(t *testing.T) {
+	store, _ := setupTest(t)
+	if rec := callAPI(t, http.MethodPost, "/api/signUp", LoginRequest{Account: "carol", Username: "Carol", Email: "carol@example.com", Password: "pw"}); rec.Code != http.StatusOK {
+		t.Fatalf("signUp status = %d", rec.Code)
+	}
+	m := store.member("carol")
+	m.emailVerified = true
+	secret, err := cloudkey.NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.mfa[m.mid] = &fakeMFA{secret: secret, enabled: true}
+
+	login := func() string {
+		t.Helper()
+		resp := decodeLogin(t, callAPI(t, http.MethodPost, "/api/login", LoginRequest{Account: "carol", Password: "pw"}))
+		if !resp.MFARequired || resp.MFAToken == "" || resp.AccessToken != "" {
+			t.Fatalf("login response = %+v, want an mfa token only", resp)
+		}
+		return resp.MFAToken
+	}
+
+	mfaToken := login()
+	code := totpNow(t, secret)
+	if rec := callAPI(t, http.MethodPost, "/api/login/mfa", MFARequest{MFAToken: mfaToken, Code: "000000"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := callAPI(t, http.MethodPost, "/api/login/mfa", MFARequest{MFAToken: mfaToken, Code: code})
+	if resp := decodeLogin(t, rec); resp.AccessToken == "" {
+		t.Fatalf("mfa login status = %d, want tokens", rec.Code)
+	}
+	if _, ok := store.mfa[m.mid].lastCounter.(int64); !ok {
+		t.Error("used time step was not recorded")
+	}
+
+	// MFA Token 已使用過
+	if rec := callAPI(t, http.MethodPost, "/api/login/mfa", MFARequest{MFAToken: mfaToken, Code: code}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused mfa token status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	// 新的 MFA Token 也不能重複使用同一個時間區間的驗證碼
+	if rec := callAPI(t, http.MethodPost, "/api/login/mfa", MFARequest{MFAToken: login(), Code: code}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replayed code status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
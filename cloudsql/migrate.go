@@ -0,0 +1,181 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations 建立服務需要的資料表，每段語法都需可重複執行
+// (Members、Images 與預存程序由既有的資料庫腳本建立)
+var migrations = []string{
+	// argon2id 雜湊需要較長的欄位
+	`IF COL_LENGTH('dbo.Members', 'userpassword') < 255
+	ALTER TABLE dbo.Members ALTER COLUMN userpassword VARCHAR(255)`,
+	// 產生密碼 MAC 的 KMS 金鑰版本，NULL 為輪替前的舊資料
+	`IF COL_LENGTH('dbo.Members', 'macKeyVersion') IS NULL
+	ALTER TABLE dbo.Members ADD macKeyVersion VARCHAR(32) NULL`,
+	// Refresh Token，只保存雜湊值；同一次登入輪替出的 Token 共用 family
+	`IF OBJECT_ID(N'dbo.RefreshTokens', N'U') IS NULL
+	CREATE TABLE dbo.RefreshTokens (
+		id          BIGINT IDENTITY(1,1) PRIMARY KEY,
+		mid         INT NOT NULL,
+		family      VARCHAR(64) NOT NULL,
+		tokenHash   CHAR(64) NOT NULL UNIQUE,
+		expiresAt   DATETIME2 NOT NULL,
+		usedAt      DATETIME2 NULL,
+		revokedAt   DATETIME2 NULL,
+		createdTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		INDEX IX_RefreshTokens_family (family)
+	)`,
+	// 已撤銷的 Access Token (jti)，過期後即可清除
+	`IF OBJECT_ID(N'dbo.RevokedTokens', N'U') IS NULL
+	CREATE TABLE dbo.RevokedTokens (
+		jti       VARCHAR(64) NOT NULL PRIMARY KEY,
+		expiresAt DATETIME2 NOT NULL
+	)`,
+	// 登入失敗次數與鎖定狀態，key 為 account:<帳號> 或 ip:<IP>
+	`IF OBJECT_ID(N'dbo.LoginAttempts', N'U') IS NULL
+	CREATE TABLE dbo.LoginAttempts (
+		attemptKey  VARCHAR(300) NOT NULL PRIMARY KEY,
+		failures    INT NOT NULL,
+		lastFailure DATETIME2 NOT NULL,
+		lockedUntil DATETIME2 NULL
+	)`,
+	// TOTP 密鑰，enabled = 0 表示尚未完成驗證；lastCounter 防止驗證碼重複使用
+	`IF OBJECT_ID(N'dbo.MemberMFA', N'U') IS NULL
+	CREATE TABLE dbo.MemberMFA (
+		mid         INT NOT NULL PRIMARY KEY,
+		secret      VARCHAR(64) NOT NULL,
+		enabled     BIT NOT NULL DEFAULT 0,
+		lastCounter BIGINT NULL,
+		createdTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+	)`,
+	// TOTP 一次性備用碼，只保存雜湊值
+	`IF OBJECT_ID(N'dbo.MFARecoveryCodes', N'U') IS NULL
+	CREATE TABLE dbo.MFARecoveryCodes (
+		id       BIGINT IDENTITY(1,1) PRIMARY KEY,
+		mid      INT NOT NULL,
+		codeHash CHAR(64) NOT NULL,
+		usedAt   DATETIME2 NULL,
+		INDEX IX_MFARecoveryCodes_mid (mid)
+	)`,
+	// Email 驗證；既有帳號視為已驗證
+	`IF COL_LENGTH('dbo.Members', 'email') IS NULL
+	ALTER TABLE dbo.Members ADD email NVARCHAR(320) NULL`,
+	`IF COL_LENGTH('dbo.Members', 'emailVerified') IS NULL
+	ALTER TABLE dbo.Members ADD emailVerified BIT NOT NULL DEFAULT 1`,
+	// 重設密碼 Token，只保存雜湊值且只能使用一次
+	`IF OBJECT_ID(N'dbo.PasswordResets', N'U') IS NULL
+	CREATE TABLE dbo.PasswordResets (
+		tokenHash   CHAR(64) NOT NULL PRIMARY KEY,
+		mid         INT NOT NULL,
+		expiresAt   DATETIME2 NOT NULL,
+		usedAt      DATETIME2 NULL,
+		createdTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+	)`,
+	// OIDC 登入的外部身分，(provider, subject) 對應到一個會員
+	`IF OBJECT_ID(N'dbo.MemberIdentities', N'U') IS NULL
+	CREATE TABLE dbo.MemberIdentities (
+		id          INT IDENTITY(1,1) PRIMARY KEY,
+		provider    VARCHAR(64) NOT NULL,
+		subject     NVARCHAR(255) NOT NULL,
+		mid         INT NOT NULL,
+		email       NVARCHAR(320) NULL,
+		createdTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		CONSTRAINT UQ_MemberIdentities_subject UNIQUE (provider, subject),
+		INDEX IX_MemberIdentities_mid (mid)
+	)`,
+	// 個人 API Key，只保存雜湊值
+	`IF OBJECT_ID(N'dbo.ApiKeys', N'U') IS NULL
+	CREATE TABLE dbo.ApiKeys (
+		id          INT IDENTITY(1,1) PRIMARY KEY,
+		mid         INT NOT NULL,
+		name        NVARCHAR(100) NOT NULL,
+		hint        VARCHAR(16) NOT NULL,
+		keyHash     CHAR(64) NOT NULL UNIQUE,
+		scopes      VARCHAR(100) NOT NULL,
+		expiresAt   DATETIME2 NULL,
+		lastUsedAt  DATETIME2 NULL,
+		revokedAt   DATETIME2 NULL,
+		createdTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		INDEX IX_ApiKeys_mid (mid)
+	)`,
+	// 角色: admin, member, readonly；停用的帳號不能登入
+	`IF COL_LENGTH('dbo.Members', 'role') IS NULL
+	ALTER TABLE dbo.Members ADD role VARCHAR(16) NOT NULL DEFAULT 'member'`,
+	`IF COL_LENGTH('dbo.Members', 'disabled') IS NULL
+	ALTER TABLE dbo.Members ADD disabled BIT NOT NULL DEFAULT 0`,
+	// 圖片分享，version 為 NULL 時分享所有版本
+	`IF OBJECT_ID(N'dbo.ImageShares', N'U') IS NULL
+	CREATE TABLE dbo.ImageShares (
+		id          INT IDENTITY(1,1) PRIMARY KEY,
+		ownerMid    INT NOT NULL,
+		granteeMid  INT NOT NULL,
+		imageName   NVARCHAR(255) NOT NULL,
+		version     INT NULL,
+		permission  VARCHAR(16) NOT NULL,
+		createdTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		CONSTRAINT UQ_ImageShares UNIQUE (ownerMid, granteeMid, imageName, version),
+		INDEX IX_ImageShares_grantee (granteeMid)
+	)`,
+	// 公開分享連結，只保存 Token 雜湊值
+	`IF OBJECT_ID(N'dbo.ShareLinks', N'U') IS NULL
+	CREATE TABLE dbo.ShareLinks (
+		id                 INT IDENTITY(1,1) PRIMARY KEY,
+		ownerMid           INT NOT NULL,
+		tokenHash          CHAR(64) NOT NULL UNIQUE,
+		filename           NVARCHAR(512) NOT NULL,
+		passwordHash       VARCHAR(255) NULL,
+		passwordKeyVersion VARCHAR(32) NULL,
+		expiresAt          DATETIME2 NULL,
+		maxDownloads       INT NULL,
+		downloads          INT NOT NULL DEFAULT 0,
+		lastAccessAt       DATETIME2 NULL,
+		revokedAt          DATETIME2 NULL,
+		createdTime        DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		INDEX IX_ShareLinks_owner (ownerMid)
+	)`,
+	// 刪除帳號的背景工作，帳號刪除後仍保留進度供查詢
+	`IF OBJECT_ID(N'dbo.AccountDeletions', N'U') IS NULL
+	CREATE TABLE dbo.AccountDeletions (
+		id          INT IDENTITY(1,1) PRIMARY KEY,
+		mid         INT NOT NULL,
+		account     NVARCHAR(320) NOT NULL,
+		tokenHash   CHAR(64) NOT NULL UNIQUE,
+		status      VARCHAR(16) NOT NULL,
+		error       NVARCHAR(1000) NULL,
+		requestedAt DATETIME2 NOT NULL,
+		completedAt DATETIME2 NULL
+	)`,
+	// 個別帳號的儲存上限，NULL 表示使用預設值
+	`IF COL_LENGTH('dbo.Members', 'quotaBytes') IS NULL
+	ALTER TABLE dbo.Members ADD quotaBytes BIGINT NULL, quotaImages INT NULL`,
+	// 上傳與刪除時增量更新的使用量，不需掃描 Bucket
+	`IF OBJECT_ID(N'dbo.StorageUsage', N'U') IS NULL
+	CREATE TABLE dbo.StorageUsage (
+		mid         INT PRIMARY KEY,
+		bytes       BIGINT NOT NULL DEFAULT 0,
+		images      INT NOT NULL DEFAULT 0,
+		updatedTime DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+	)`,
+	// 上傳限制的 token bucket
+	`IF OBJECT_ID(N'dbo.RateBuckets', N'U') IS NULL
+	CREATE TABLE dbo.RateBuckets (
+		bucketKey   NVARCHAR(400) PRIMARY KEY,
+		tokens      FLOAT NOT NULL,
+		updatedTime DATETIME2 NOT NULL
+	)`,
+	// 刪除的執行權與重試次數，避免多個執行個體同時處理同一筆刪除
+	`IF COL_LENGTH('dbo.AccountDeletions', 'claimedAt') IS NULL
+	ALTER TABLE dbo.AccountDeletions ADD claimedAt DATETIME2 NULL, attempts INT NOT NULL DEFAULT 0`,
+}
+
+// migrateDB :
+func migrateDB(db *sql.DB) error {
+	for i, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package cloudsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudstorage"
+)
+
+// oidcCookie 保存 OIDC 登入流程狀態的 Cookie
+const oidcCookie = "i2c_oidc"
+
+// unusablePassword OIDC 建立的帳號沒有密碼，此值不可能通過 VerifyPassword
+const unusablePassword = "!"
+
+// oidcProviders : 列出可使用的 Provider
+func oidcProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cloudkey.OIDCProviderNames())
+}
+
+// oidcLogin : 導向 Provider 的登入頁
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cloudkey.GetOIDCProvider(r.FormValue("provider"))
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusBadRequest)
+		return
+	}
+	authURL, stateToken, err := provider.AuthCodeURL(r.Context())
+	if err != nil {
+		log.Printf("Error: unable to start oidc login: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    stateToken,
+		Path:     "/api/oidc/",
+		MaxAge:   int(cloudkey.OIDCStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   !insecureCookies,
+		// Provider 導回時為跨站的 top-level GET，Lax 才會帶上 Cookie
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallback : Provider 導回後建立或連結會員，登入結果寫入 Session Cookie；
+// 需要 MFA 時只以 URL fragment 帶回短效的 MFA Token
+func oidcCallback(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/api/oidc/", MaxAge: -1})
+
+	if e := r.FormValue("error"); e != "" {
+		log.Printf("oidc login error: %s", e)
+		http.Redirect(w, r, "/#error=oidc", http.StatusFound)
+		return
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "Missing login state", http.StatusBadRequest)
+		return
+	}
+	provider, state, err := cloudkey.ParseOIDCState(cookie.Value, r.FormValue("state"))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	identity, err := provider.Exchange(r.Context(), state, r.FormValue("code"))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	mid, account, username, err := linkIdentity(r.Context(), db, identity)
+	if err != nil {
+		log.Printf("Error: unable to link oidc identity: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	enabled, err := mfaEnabled(db, mid)
+	if err != nil {
+		log.Printf("Error: unable to check mfa: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		mfaToken, err := cloudkey.CreateMFAToken(mid, account, username)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// fragment 不會送到伺服器或出現在 Referer
+		http.Redirect(w, r, "/#"+url.Values{"mfaToken": {mfaToken}}.Encode(), http.StatusFound)
+		return
+	}
+
+	resp, err := issueTokens(db, mid, "")
+	if errors.Is(err, errAccountDisabled) {
+		http.Redirect(w, r, "/#error=disabled", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to issue token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := setSessionCookies(w, resp); err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// linkIdentity : 依 (provider, sub) 找到會員；第一次登入時以已驗證的 Email
+// 連結既有帳號，沒有對應帳號則建立新會員
+func linkIdentity(ctx context.Context, db *sql.DB, id *cloudkey.OIDCIdentity) (mid int, account, username string, err error) {
+	findIdentity := `SELECT m.mid, m.account, m.username FROM MemberIdentities i JOIN Members m ON m.mid = i.mid
+		WHERE i.provider = @provider AND i.subject = @subject`
+	err = db.QueryRowContext(ctx, findIdentity, sql.Named("provider", id.Provider), sql.Named("subject", id.Subject)).Scan(&mid, &account, &username)
+	if err == nil {
+		return mid, account, username, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", "", err
+	}
+
+	// 只信任 Provider 已驗證的 Email
+	if id.Email == "" || !id.EmailVerified {
+		return 0, "", "", fmt.Errorf("%s identity %s has no verified email", id.Provider, id.Subject)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer tx.Rollback()
+
+	findMember := "SELECT mid, account, username FROM Members WHERE email = @email AND emailVerified = 1"
+	err = tx.QueryRowContext(ctx, findMember, sql.Named("email", id.Email)).Scan(&mid, &account, &username)
+	if errors.Is(err, sql.ErrNoRows) {
+		account = strings.ToLower(id.Email)
+		// Email 的 local part 可以包含 "/" 等字元，不能作為物件路徑時改用 Provider 身分產生
+		if !cloudstorage.ValidAccount(account) {
+			account = oidcAccount(id)
+		}
+		username = id.Name
+		if username == "" {
+			username = account
+		}
+		addUser := "INSERT INTO Members (account, username, email, emailVerified, userpassword, createdTime) OUTPUT inserted.mid VALUES (@account, @username, @email, 1, @password, GETDATE())"
+		err = tx.QueryRowContext(ctx, addUser, sql.Named("account", account), sql.Named("username", username), sql.Named("email", id.Email), sql.Named("password", unusablePassword)).Scan(&mid)
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	addIdentity := "INSERT INTO MemberIdentities (provider, subject, mid, email) VALUES (@provider, @subject, @mid, @email)"
+	if _, err := tx.ExecContext(ctx, addIdentity, sql.Named("provider", id.Provider), sql.Named("subject", id.Subject), sql.Named("mid", mid), sql.Named("email", id.Email)); err != nil {
+		return 0, "", "", err
+	}
+	return mid, account, username, tx.Commit()
+}
+
+// oidcAccount : 以 (provider, sub) 的雜湊產生固定的帳號名稱
+func oidcAccount(id *cloudkey.OIDCIdentity) string {
+	sum := sha256.Sum256([]byte(id.Provider + "\x00" + id.Subject))
+	return "oidc-" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,311 @@
+package cloudsql
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// mockIssuer : 提供 Discovery、JWKS 與 token endpoint 的 OpenID Provider
+type mockIssuer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant : 使用者在 Provider 登入後核發的 authorization code
+type mockGrant struct {
+	challenge string
+	nonce     string
+	subject   string
+	email     string
+}
+
+// newMockIssuer :
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string]mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(cloudkey.JWKS{Keys: []cloudkey.JWK{{
+			Kty: "EC", Kid: "mock", Use: "sig", Alg: "ES256", Crv: "P-256",
+			X: enc.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y: enc.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// grant : 模擬使用者在 Provider 完成登入，記錄 authorization request 的 PKCE challenge
+func (m *mockIssuer) grant(code string, g mockGrant) {
+	m.mu.Lock()
+	m.codes[code] = g
+	m.mu.Unlock()
+}
+
+// token : 檢查 PKCE verifier 後簽發 ID Token，code 只能使用一次
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	g, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            "client",
+		"sub":            g.subject,
+		"email":          g.email,
+		"email_verified": true,
+		"name":           "Mock User",
+		"nonce":          g.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "mock"
+	signed, err := idToken.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+// setupOIDC : 設定指向 mockIssuer 的 Provider "mock"
+func setupOIDC(t *testing.T) *mockIssuer {
+	t.Helper()
+	issuer := newMockIssuer(t)
+	config, _ := json.Marshal([]map[string]string{{
+		"name":         "mock",
+		"issuer":       issuer.URL,
+		"clientId":     "client",
+		"clientSecret": "secret",
+		"redirectUrl":  "http://localhost:8080/api/oidc/callback",
+	}})
+	path := filepath.Join(t.TempDir(), "oidc.json")
+	if err := os.WriteFile(path, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloudkey.LoadOIDCProviders(path); err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+// startOIDC : 開始登入，回傳狀態 Cookie 與導向 Provider 的參數
+func startOIDC(t *testing.T) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := callAPI(t, http.MethodGet, "/api/oidc/login?provider=mock", nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("oidc login status = %d: %s", rec.Code, rec.Body)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("authorization url = %s", loc)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcCookie {
+			if !c.HttpOnly || !c.Secure {
+				t.Errorf("state cookie = %+v, want HttpOnly and Secure", c)
+			}
+			return c, q
+		}
+	}
+	t.Fatal("missing oidc state cookie")
+	return nil, nil
+}
+
+// oidcCallbackURL :
+func oidcCallbackURL(state, code string) string {
+	return "/api/oidc/callback?" + url.Values{"state": {state}, "code": {code}}.Encode()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	store, _ := setupTest(t)
+	issuer := setupOIDC(t)
+
+	cookie, q := startOIDC(t)
+	issuer.grant("good", mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: "user-1", email: "Frank@Example.com"})
+	rec := callAPI(t, http.MethodGet, oidcCallbackURL(q.Get("state"), "good"), nil, cookie)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+		t.Fatalf("callback = %d %q, want redirect to /", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Token 只放在 HttpOnly Cookie，不出現在網址
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == cloudkey.SessionCookie {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly || !session.Secure {
+		t.Fatalf("session cookie = %+v", session)
+	}
+	claims, err := cloudkey.ValidateToken(session.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := store.member("frank@example.com")
+	if m == nil || !m.emailVerified || claims.UID != m.mid {
+		t.Fatalf("member = %+v, claims = %+v", m, claims)
+	}
+
+	// 再次登入時以 (provider, sub) 找到同一個會員
+	cookie, q = startOIDC(t)
+	issuer.grant("again", mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: "user-1", email: "changed@example.com"})
+	if rec := callAPI(t, http.MethodGet, oidcCallbackURL(q.Get("state"), "again"), nil, cookie); rec.Code != http.StatusFound {
+		t.Fatalf("second callback status = %d", rec.Code)
+	}
+	if len(store.members) != 1 {
+		t.Errorf("got %d members, want 1", len(store.members))
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	store, _ := setupTest(t)
+	issuer := setupOIDC(t)
+
+	tests := []struct {
+		name   string
+		modify func(cookie *http.Cookie, q url.Values, g *mockGrant) (*http.Cookie, string)
+		want   int
+	}{
+		{
+			name: "state mismatch",
+			modify: func(cookie *http.Cookie, q url.Values, g *mockGrant) (*http.Cookie, string) {
+				return cookie, "other-state"
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "missing state cookie",
+			modify: func(cookie *http.Cookie, q url.Values, g *mockGrant) (*http.Cookie, string) {
+				return nil, q.Get("state")
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "forged state cookie",
+			modify: func(cookie *http.Cookie, q url.Values, g *mockGrant) (*http.Cookie, string) {
+				parts := strings.Split(cookie.Value, ".")
+				forged := *cookie
+				forged.Value = parts[0] + "." + parts[1] + ".c2lnbmF0dXJl"
+				return &forged, q.Get("state")
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "nonce mismatch",
+			modify: func(cookie *http.Cookie, q url.Values, g *mockGrant) (*http.Cookie, string) {
+				g.nonce = "other-nonce"
+				return cookie, q.Get("state")
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "pkce verifier mismatch",
+			modify: func(cookie *http.Cookie, q url.Values, g *mockGrant) (*http.Cookie, string) {
+				sum := sha256.Sum256([]byte("another verifier"))
+				g.challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+				return cookie, q.Get("state")
+			},
+			want: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookie, q := startOIDC(t)
+			g := mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: "user-2", email: "gina@example.com"}
+			cookie, state := tt.modify(cookie, q, &g)
+			issuer.grant("code", g)
+
+			var cookies []*http.Cookie
+			if cookie != nil {
+				cookies = append(cookies, cookie)
+			}
+			rec := callAPI(t, http.MethodGet, oidcCallbackURL(state, "code"), nil, cookies...)
+			if rec.Code != tt.want {
+				t.Errorf("callback status = %d, want %d", rec.Code, tt.want)
+			}
+			for _, c := range rec.Result().Cookies() {
+				if c.Name == cloudkey.SessionCookie && c.Value != "" {
+					t.Error("rejected callback set a session cookie")
+				}
+			}
+		})
+	}
+	if len(store.members) != 0 {
+		t.Errorf("rejected logins created %d members", len(store.members))
+	}
+}
+
+// Email 的 local part 不能作為物件路徑時，以 Provider 身分產生帳號
+func TestOIDCAccountFromUnsafeEmail(t *testing.T) {
+	store, _ := setupTest(t)
+	issuer := setupOIDC(t)
+
+	cookie, q := startOIDC(t)
+	issuer.grant("code", mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: "user-3", email: "a/../b@example.com"})
+	if rec := callAPI(t, http.MethodGet, oidcCallbackURL(q.Get("state"), "code"), nil, cookie); rec.Code != http.StatusFound {
+		t.Fatalf("callback status = %d", rec.Code)
+	}
+	if len(store.members) != 1 {
+		t.Fatalf("got %d members, want 1", len(store.members))
+	}
+	for _, m := range store.members {
+		if !strings.HasPrefix(m.account, "oidc-") || strings.ContainsAny(m.account, "/.") {
+			t.Errorf("account = %q, want a generated oidc- account", m.account)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid account or password")
+	errAccountDisabled    = errors.New("account disabled")
+)
+
+// verifyMember : 驗證帳號密碼，舊格式或舊參數的雜湊會在驗證成功後更新。
+// 帳號已停用時回傳 errAccountDisabled，Email 尚未驗證時回傳 errEmailNotVerified
+func verifyMember(db *sql.DB, account, password string) (mid int, username string, err error) {
+	var (
+		encoded            string
+		keyVersion         sql.NullString
+		verified, disabled bool
+	)
+	findMember := "SELECT mid, username, userpassword, macKeyVersion, emailVerified, disabled FROM Members WHERE account = @account"
+	err = db.QueryRow(findMember, sql.Named("account", account)).Scan(&mid, &username, &encoded, &keyVersion, &verified, &disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		// 帳號不存在時仍計算一次雜湊，避免以回應時間判斷帳號是否存在
+		cloudkey.HashPassword(password)
+		return 0, "", errInvalidCredentials
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	// macKeyVersion 為 NULL 的舊資料使用 legacy 金鑰版本
+	ok, rehash, err := cloudkey.VerifyPassword(password, encoded, keyVersion.String)
+	if err != nil {
+		return 0, "", err
+	}
+	if !ok {
+		return 0, "", errInvalidCredentials
+	}
+	if rehash {
+		if err := setPassword(db, mid, password); err != nil {
+			log.Printf("Error: unable to rehash password for mid %d: %v", mid, err)
+		}
+	}
+	// 密碼正確後才回報帳號狀態，避免洩漏帳號是否存在
+	if disabled {
+		return 0, "", errAccountDisabled
+	}
+	if !verified {
+		return 0, "", errEmailNotVerified
+	}
+	return mid, username, nil
+}
+
+// setPassword : 以目前的參數與 MAC 金鑰版本儲存密碼
+func setPassword(db *sql.DB, mid int, password string) error {
+	hash, version, err := cloudkey.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	updatePassword := "UPDATE Members SET userpassword = @password, macKeyVersion = @version WHERE mid = @mid"
+	_, err = db.Exec(updatePassword, sql.Named("password", hash), sql.Named("version", nullString(version)), sql.Named("mid", mid))
+	return err
+}
+
+// nullString : 空字串存為 NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,175 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/rellik24/image2cloud/cloudstorage"
+)
+
+// Quota : 帳號的儲存上限，0 表示不限制
+type Quota struct {
+	Bytes  int64 `json:"bytes"`
+	Images int   `json:"images"`
+}
+
+// defaultQuota 沒有個別設定時使用的上限
+var defaultQuota = Quota{Bytes: 1 << 30, Images: 1000}
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// SetDefaultQuota : 設定預設的儲存上限
+func SetDefaultQuota(q Quota) {
+	defaultQuota = q
+}
+
+// UsageResponse : 目前使用量與上限
+type UsageResponse struct {
+	Account string `json:"account,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Images  int    `json:"images"`
+	Limit   Quota  `json:"limit"`
+	// Unseeded : 尚未建立使用量紀錄 (從未上傳或查詢使用量)，Bytes 與 Images 尚未計算
+	Unseeded bool `json:"unseeded,omitempty"`
+}
+
+type QuotaRequest struct {
+	Account string `json:"account"`
+	// nil 表示改回預設值，0 表示不限制
+	Bytes  *int64 `json:"bytes"`
+	Images *int   `json:"images"`
+}
+
+// ensureUsage : 第一次使用時以 Storage 的現有物件建立使用量，之後只做增量更新。
+// 目前沒有刪除單張圖片的 API，使用量只在上傳失敗時歸還，刪除帳號時連同資料列一併刪除
+func ensureUsage(ctx context.Context, db *sql.DB, mid int, account string) error {
+	var exists int
+	err := db.QueryRowContext(ctx, "SELECT 1 FROM StorageUsage WHERE mid = @mid", sql.Named("mid", mid)).Scan(&exists)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	usage, err := cloudstorage.AccountUsage(ctx, account)
+	if err != nil {
+		return err
+	}
+	// UPDLOCK, HOLDLOCK 鎖住檢查的範圍，同時第一次上傳時只有一個請求會寫入
+	seed := `INSERT INTO StorageUsage (mid, bytes, images)
+		SELECT @mid, @bytes, @images
+		WHERE NOT EXISTS (SELECT 1 FROM StorageUsage WITH (UPDLOCK, HOLDLOCK) WHERE mid = @mid)`
+	_, err = db.ExecContext(ctx, seed, sql.Named("mid", mid), sql.Named("bytes", usage.Bytes), sql.Named("images", usage.Objects))
+	return err
+}
+
+// reserveUsage : 寫入 Storage 之前先預留空間，超過上限時回傳 errQuotaExceeded
+func reserveUsage(ctx context.Context, db *sql.DB, mid int, account string, bytes int64, images int) error {
+	if err := ensureUsage(ctx, db, mid, account); err != nil {
+		return err
+	}
+	// 以條件更新讓同時上傳也不會超過上限
+	reserve := `UPDATE u SET bytes = u.bytes + @bytes, images = u.images + @images, updatedTime = SYSUTCDATETIME()
+		FROM StorageUsage u JOIN Members m ON m.mid = u.mid
+		WHERE u.mid = @mid
+		AND (COALESCE(m.quotaBytes, @defaultBytes) <= 0 OR u.bytes + @bytes <= COALESCE(m.quotaBytes, @defaultBytes))
+		AND (COALESCE(m.quotaImages, @defaultImages) <= 0 OR u.images + @images <= COALESCE(m.quotaImages, @defaultImages))`
+	res, err := db.ExecContext(ctx, reserve,
+		sql.Named("mid", mid),
+		sql.Named("bytes", bytes),
+		sql.Named("images", images),
+		sql.Named("defaultBytes", defaultQuota.Bytes),
+		sql.Named("defaultImages", defaultQuota.Images),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// releaseUsage : 上傳失敗時歸還預留的使用量，之後新增刪除圖片的 API 時也需呼叫
+func releaseUsage(ctx context.Context, db *sql.DB, mid int, bytes int64, images int) error {
+	release := `UPDATE StorageUsage SET bytes = CASE WHEN bytes > @bytes THEN bytes - @bytes ELSE 0 END,
+		images = CASE WHEN images > @images THEN images - @images ELSE 0 END, updatedTime = SYSUTCDATETIME()
+		WHERE mid = @mid`
+	_, err := db.ExecContext(ctx, release, sql.Named("mid", mid), sql.Named("bytes", bytes), sql.Named("images", images))
+	return err
+}
+
+// accountUsage : 讀取使用量與上限
+func accountUsage(ctx context.Context, db *sql.DB, mid int, account string) (UsageResponse, error) {
+	if err := ensureUsage(ctx, db, mid, account); err != nil {
+		return UsageResponse{}, err
+	}
+	var (
+		u                       UsageResponse
+		quotaBytes, quotaImages sql.NullInt64
+	)
+	findUsage := `SELECT u.bytes, u.images, m.quotaBytes, m.quotaImages FROM StorageUsage u JOIN Members m ON m.mid = u.mid WHERE u.mid = @mid`
+	if err := db.QueryRowContext(ctx, findUsage, sql.Named("mid", mid)).Scan(&u.Bytes, &u.Images, &quotaBytes, &quotaImages); err != nil {
+		return UsageResponse{}, err
+	}
+	u.Limit = quotaLimit(quotaBytes, quotaImages)
+	return u, nil
+}
+
+// quotaLimit : 未個別設定的欄位使用預設值
+func quotaLimit(quotaBytes, quotaImages sql.NullInt64) Quota {
+	q := defaultQuota
+	if quotaBytes.Valid {
+		q.Bytes = quotaBytes.Int64
+	}
+	if quotaImages.Valid {
+		q.Images = int(quotaImages.Int64)
+	}
+	return q
+}
+
+// usage : 目前帳號的使用量
+func usage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	u, err := accountUsage(r.Context(), db, p.UID, p.Account)
+	if err != nil {
+		log.Printf("Error: unable to get usage: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// setQuota : 管理者設定帳號的上限，未指定的欄位改回預設值
+func setQuota(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req QuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	var quotaBytes, quotaImages sql.NullInt64
+	if req.Bytes != nil {
+		quotaBytes = sql.NullInt64{Int64: *req.Bytes, Valid: true}
+	}
+	if req.Images != nil {
+		quotaImages = sql.NullInt64{Int64: int64(*req.Images), Valid: true}
+	}
+	setQuota := "UPDATE Members SET quotaBytes = @bytes, quotaImages = @images WHERE account = @account"
+	res, err := db.Exec(setQuota, sql.Named("bytes", quotaBytes), sql.Named("images", quotaImages), sql.Named("account", req.Account))
+	if err != nil {
+		log.Printf("Error: unable to set quota: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("%s set quota of %s", principal(r).Account, req.Account)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package cloudsql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/rellik24/image2cloud/cloudimage"
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// pngItem : 內容為 1x1 PNG 的上傳檔案
+func pngItem(t *testing.T, name string) *uploadItem {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	return &uploadItem{
+		UploadResult: UploadResult{Name: name},
+		filename:     name,
+		size:         int64(len(data)),
+		open: func() (uploadSource, error) {
+			return memorySource{bytes.NewReader(data)}, nil
+		},
+	}
+}
+
+func TestStoreImageRejectsOverQuota(t *testing.T) {
+	store, _ := setupTest(t)
+	alice := store.addMember("alice")
+	alice.quotaImages = int64(2)
+	store.usage[alice.mid] = &fakeUsage{bytes: 100, images: 2}
+
+	ws, err := cloudimage.NewWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// 超過上限時在寫入暫存或 Storage 之前拒絕
+	p := &cloudkey.Principal{UID: alice.mid, Account: alice.account}
+	_, _, err = storeImage(context.Background(), getDB(), ws, p, pngItem(t, "cat.png"))
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("storeImage error = %v, want %v", err, errQuotaExceeded)
+	}
+	if u := store.usage[alice.mid]; u.bytes != 100 || u.images != 2 {
+		t.Errorf("usage = %+v, want unchanged", *u)
+	}
+
+	item := pngItem(t, "cat.png")
+	item.setError(err)
+	if item.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", item.Status, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestStoreImageReleasesUsageOnFailure(t *testing.T) {
+	store, _ := setupTest(t)
+	alice := store.addMember("alice")
+	store.usage[alice.mid] = &fakeUsage{bytes: 100, images: 2}
+
+	ws, err := cloudimage.NewWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// 預留之後的查詢沒有對應的 fakeQuery 而失敗，預留的使用量需歸還
+	p := &cloudkey.Principal{UID: alice.mid, Account: alice.account}
+	if _, _, err := storeImage(context.Background(), getDB(), ws, p, pngItem(t, "cat.png")); err == nil {
+		t.Fatal("storeImage succeeded without storage")
+	}
+	if u := store.usage[alice.mid]; u.bytes != 100 || u.images != 2 {
+		t.Errorf("usage = %+v, want released", *u)
+	}
+}
+
+func TestStorageUsageListsUnseededAccounts(t *testing.T) {
+	store, _ := setupTest(t)
+	admin, alice := store.addMember("admin"), store.addMember("alice")
+	admin.role = cloudkey.RoleAdmin
+	store.usage[alice.mid] = &fakeUsage{bytes: 2048, images: 3}
+
+	rec := callHandler(t, storageUsage, admin, http.MethodGet, "/api/admin/usage", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var result []UsageResponse
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]UsageResponse)
+	for _, u := range result {
+		got[u.Account] = u
+	}
+	if u, ok := got["admin"]; !ok || !u.Unseeded {
+		t.Errorf("admin = %+v, want unseeded", u)
+	}
+	if u := got["alice"]; u.Unseeded || u.Bytes != 2048 || u.Images != 3 || u.Limit != defaultQuota {
+		t.Errorf("alice = %+v, want 2048 bytes in 3 images", u)
+	}
+}
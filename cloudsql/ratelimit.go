@@ -0,0 +1,146 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+var uploadLimiter *cloudkey.UploadLimiter
+
+// SetUploadLimiter : 設定上傳的頻率限制，未設定時不限制
+func SetUploadLimiter(l *cloudkey.UploadLimiter) {
+	uploadLimiter = l
+}
+
+var mailLimiter *cloudkey.MailLimiter
+
+// SetMailLimiter : 設定不需登入即可寄信的 API 的頻率限制，未設定時不限制
+func SetMailLimiter(l *cloudkey.MailLimiter) {
+	mailLimiter = l
+}
+
+var rateLimitMessages = map[string]string{
+	"requests":    "too many uploads, try again later",
+	"bytes":       "upload bandwidth exceeded, try again later",
+	"concurrency": "too many uploads in progress",
+	"mail":        "too many emails requested, try again later",
+}
+
+// tooManyRequests : 回傳 429 與 Retry-After
+func tooManyRequests(w http.ResponseWriter, d cloudkey.RateDecision) {
+	if d.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(d.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(cloudkey.AuthError{Error: "rate_limited", Message: rateLimitMessages[d.Reason]})
+}
+
+// limitUpload : 在讀取檔案之前檢查上傳限制，通過時回傳結束上傳後需呼叫的 release
+func limitUpload(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if uploadLimiter == nil {
+		return func() {}, true
+	}
+	// 以 Content-Length 計算流量，不接受長度未知的上傳
+	if r.ContentLength < 0 {
+		http.Error(w, "Length Required", http.StatusLengthRequired)
+		return nil, false
+	}
+
+	p := principal(r)
+	release, ok = uploadLimiter.Acquire(p.Account)
+	if !ok {
+		tooManyRequests(w, cloudkey.RateDecision{Reason: "concurrency"})
+		return nil, false
+	}
+	d, err := uploadLimiter.Allow(r.Context(), p.Account, p.APIKeyID, r.ContentLength)
+	if err != nil {
+		release()
+		log.Printf("Error: unable to check upload limit: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if d.Limit > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	}
+	if !d.Allowed() {
+		release()
+		tooManyRequests(w, d)
+		return nil, false
+	}
+	return release, true
+}
+
+// limitMail : 寄信之前依帳號與 IP 檢查限制，被拒絕時回傳 429
+func limitMail(w http.ResponseWriter, r *http.Request, account string) bool {
+	if mailLimiter == nil {
+		return true
+	}
+	d, err := mailLimiter.Allow(r.Context(), account, clientIP(r))
+	if err != nil {
+		log.Printf("Error: unable to check mail limit: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if !d.Allowed() {
+		tooManyRequests(w, d)
+		return false
+	}
+	return true
+}
+
+// SQLBucketStore : 以 RateBuckets 資料表實作 cloudkey.BucketStore，
+// 讓多個 Cloud Run 執行個體共用上傳與寄信限制
+type SQLBucketStore struct{}
+
+// Take :
+func (SQLBucketStore) Take(ctx context.Context, reqs []cloudkey.BucketRequest) ([]cloudkey.BucketResult, error) {
+	tx, err := getDB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	tokens := make([]float64, len(reqs))
+	// UPDLOCK/HOLDLOCK 讓同一個 bucket 的請求依序處理，不存在時也會鎖定該 key。
+	// 呼叫端以固定順序 (帳號、API Key 或 IP) 傳入，避免互相等待
+	getBucket := "SELECT tokens, updatedTime FROM RateBuckets WITH (UPDLOCK, HOLDLOCK) WHERE bucketKey = @key"
+	for i, req := range reqs {
+		var updated time.Time
+		err := tx.QueryRowContext(ctx, getBucket, sql.Named("key", req.Key)).Scan(&tokens[i], &updated)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			tokens[i], updated = req.Capacity, now
+		case err != nil:
+			return nil, err
+		}
+		tokens[i] = cloudkey.Refill(tokens[i], req.Capacity, req.Per, now.Sub(updated))
+	}
+	results, ok := cloudkey.TakeTokens(tokens, reqs)
+	if !ok {
+		// 不足時不寫入，下次仍由原本的時間補充
+		return results, nil
+	}
+
+	setBucket := `UPDATE RateBuckets SET tokens = @tokens, updatedTime = @now WHERE bucketKey = @key
+		IF @@ROWCOUNT = 0
+		INSERT INTO RateBuckets (bucketKey, tokens, updatedTime) VALUES (@key, @tokens, @now)`
+	for i, req := range reqs {
+		if _, err := tx.ExecContext(ctx, setBucket, sql.Named("key", req.Key), sql.Named("tokens", results[i].Remaining), sql.Named("now", now)); err != nil {
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
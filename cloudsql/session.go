@@ -0,0 +1,87 @@
+package cloudsql
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// insecureCookies 本機以 http 開發時才關閉 Cookie 的 Secure 屬性
+var insecureCookies bool
+
+// SetInsecureCookies : 由 INSECURE_COOKIES 設定，正式環境不可開啟
+func SetInsecureCookies(insecure bool) {
+	insecureCookies = insecure
+}
+
+// writeTokens : 回傳登入結果。cookie 模式時 Token 改放在 HttpOnly Cookie，
+// 回應只包含前端送出請求時要帶的 CSRF Token
+func writeTokens(w http.ResponseWriter, resp LoginResponse, cookie bool) error {
+	if cookie {
+		csrf, err := setSessionCookies(w, resp)
+		if err != nil {
+			return err
+		}
+		resp = LoginResponse{ExpiresIn: resp.ExpiresIn, CSRFToken: csrf}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// setSessionCookies : 將 Token 寫入 HttpOnly Cookie，回傳前端需帶上的 CSRF Token
+func setSessionCookies(w http.ResponseWriter, resp LoginResponse) (string, error) {
+	csrf, err := cloudkey.NewCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	maxAge := int(cloudkey.RefreshTokenTTL.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     cloudkey.SessionCookie,
+		Value:    resp.AccessToken,
+		Path:     "/",
+		MaxAge:   int(cloudkey.TokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   !insecureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     cloudkey.RefreshCookie,
+		Value:    resp.RefreshToken,
+		Path:     "/api/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !insecureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// 前端需讀取此 Cookie，不能設為 HttpOnly
+	http.SetCookie(w, &http.Cookie{
+		Name:     cloudkey.CSRFCookie,
+		Value:    csrf,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   !insecureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrf, nil
+}
+
+// clearSessionCookies :
+func clearSessionCookies(w http.ResponseWriter) {
+	for name, path := range map[string]string{
+		cloudkey.SessionCookie: "/",
+		cloudkey.RefreshCookie: "/api/",
+		cloudkey.CSRFCookie:    "/",
+	} {
+		http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, Secure: !insecureCookies})
+	}
+}
+
+// refreshCookie : cookie 模式下從 Cookie 取得 Refresh Token
+func refreshCookie(r *http.Request) string {
+	c, err := r.Cookie(cloudkey.RefreshCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
@@ -0,0 +1,336 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分享權限，download 包含 view
+const (
+	PermissionView     = "view"
+	PermissionDownload = "download"
+)
+
+type ShareRequest struct {
+	Name string `json:"name"`
+	// Version 為 0 時分享所有版本 (含之後上傳的版本)
+	Version    int    `json:"version"`
+	Account    string `json:"account"`
+	Permission string `json:"permission"`
+}
+
+type ShareRevokeRequest struct {
+	ID int `json:"id"`
+}
+
+// Share : 分享紀錄
+type Share struct {
+	ID         int       `json:"id"`
+	Owner      string    `json:"owner,omitempty"`
+	Account    string    `json:"account,omitempty"`
+	Name       string    `json:"name"`
+	Version    int       `json:"version,omitempty"`
+	Permission string    `json:"permission"`
+	Created    time.Time `json:"created"`
+}
+
+// SharedImage : 別人分享給我的圖片
+type SharedImage struct {
+	Image
+	Owner      string `json:"owner"`
+	Permission string `json:"permission"`
+}
+
+// allows : 分享權限是否涵蓋要求的權限
+func allows(granted, required string) bool {
+	return granted == PermissionDownload || granted == required
+}
+
+// nullVersion : 0 代表所有版本，存為 NULL
+func nullVersion(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v != 0}
+}
+
+// canAccessImage : 擁有者或取得分享權限的帳號才能存取圖片，擁有者停用 (或刪除中) 時分享失效。
+// filename 為 Storage 物件路徑 "owner/link"
+func canAccessImage(db *sql.DB, account string, mid int, filename, permission string) (bool, error) {
+	return newImageAccess(db, account, mid).can(filename, permission)
+}
+
+// imageAccess : 檢查多張圖片的權限時，每個擁有者的圖片清單只查詢一次
+type imageAccess struct {
+	db      *sql.DB
+	account string
+	mid     int
+	owners  map[string][]Image
+}
+
+// newImageAccess :
+func newImageAccess(db *sql.DB, account string, mid int) *imageAccess {
+	return &imageAccess{db: db, account: account, mid: mid, owners: make(map[string][]Image)}
+}
+
+// find : 與 findImage 相同，但使用快取的圖片清單
+func (a *imageAccess) find(link string) (*Image, error) {
+	owner, _, ok := strings.Cut(link, "/")
+	if !ok {
+		return nil, nil
+	}
+	images, ok := a.owners[owner]
+	if !ok {
+		var err error
+		if images, err = listImages(a.db, owner); err != nil {
+			return nil, err
+		}
+		a.owners[owner] = images
+	}
+	for i := range images {
+		if images[i].Link == link {
+			return &images[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// can :
+func (a *imageAccess) can(filename, permission string) (bool, error) {
+	var result int
+	downloadFile := "exec dbo.DownloadImage @account, @filename"
+	if err := a.db.QueryRow(downloadFile, sql.Named("account", a.account), sql.Named("filename", filename)).Scan(&result); err != nil {
+		return false, err
+	}
+	if result != 0 {
+		return true, nil
+	}
+
+	owner, _, ok := strings.Cut(filename, "/")
+	if !ok || owner == a.account {
+		return false, nil
+	}
+	img, err := a.find(filename)
+	if err != nil || img == nil {
+		return false, err
+	}
+	version, _ := strconv.Atoi(img.Version)
+
+	rows, err := a.db.Query(`SELECT s.permission FROM ImageShares s JOIN Members m ON m.mid = s.ownerMid
+		WHERE m.account = @owner AND m.disabled = 0 AND s.granteeMid = @mid AND s.imageName = @name AND (s.version IS NULL OR s.version = @version)`,
+		sql.Named("owner", owner), sql.Named("mid", a.mid), sql.Named("name", img.Name), sql.Named("version", version))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var granted string
+		if err := rows.Scan(&granted); err != nil {
+			return false, err
+		}
+		if allows(granted, permission) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// findImage : 依物件路徑找出擁有者的圖片，找不到時回傳 nil
+func findImage(db *sql.DB, owner, link string) (*Image, error) {
+	images, err := listImages(db, owner)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		if images[i].Link == link {
+			return &images[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// shareImage : 將自己的圖片分享給其他帳號，重複分享時更新權限
+func shareImage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.Account == "" {
+		http.Error(w, "name and account are required", http.StatusBadRequest)
+		return
+	}
+	if req.Permission != PermissionView && req.Permission != PermissionDownload {
+		http.Error(w, "permission must be view or download", http.StatusBadRequest)
+		return
+	}
+	if req.Version < 0 {
+		http.Error(w, "version must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Account == p.Account {
+		http.Error(w, "cannot share with yourself", http.StatusBadRequest)
+		return
+	}
+
+	images, err := listImages(db, p.Account)
+	if err != nil {
+		log.Printf("Error: unable get image list: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, img := range images {
+		if img.Name == req.Name && (req.Version == 0 || img.Version == strconv.Itoa(req.Version)) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	var granteeMid int
+	findGrantee := "SELECT mid FROM Members WHERE account = @account AND disabled = 0"
+	err = db.QueryRow(findGrantee, sql.Named("account", req.Account)).Scan(&granteeMid)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to find member: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var id int
+	// 單一 MERGE 只回傳一個結果集；HOLDLOCK 避免同時分享時違反 UQ_ImageShares
+	upsert := `MERGE ImageShares WITH (HOLDLOCK) AS s
+		USING (SELECT @owner AS ownerMid, @grantee AS granteeMid, @name AS imageName, @version AS version) AS n
+		ON s.ownerMid = n.ownerMid AND s.granteeMid = n.granteeMid AND s.imageName = n.imageName
+		AND (s.version = n.version OR (s.version IS NULL AND n.version IS NULL))
+		WHEN MATCHED THEN
+			UPDATE SET permission = @permission
+		WHEN NOT MATCHED THEN
+			INSERT (ownerMid, granteeMid, imageName, version, permission) VALUES (@owner, @grantee, @name, @version, @permission)
+		OUTPUT inserted.id;`
+	err = db.QueryRow(upsert,
+		sql.Named("owner", p.UID),
+		sql.Named("grantee", granteeMid),
+		sql.Named("name", req.Name),
+		sql.Named("version", nullVersion(req.Version)),
+		sql.Named("permission", req.Permission),
+	).Scan(&id)
+	if err != nil {
+		log.Printf("Error: unable to share image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Share{ID: id, Account: req.Account, Name: req.Name, Version: req.Version, Permission: req.Permission, Created: time.Now().UTC()})
+}
+
+// listShares : 我分享出去的圖片
+func listShares(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	shares, err := queryShares(db, `SELECT s.id, m.account, s.imageName, s.version, s.permission, s.createdTime
+		FROM ImageShares s JOIN Members m ON m.mid = s.granteeMid WHERE s.ownerMid = @mid ORDER BY s.createdTime DESC`, principal(r).UID, false)
+	if err != nil {
+		log.Printf("Error: unable to list shares: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+// listSharedWithMe : 別人分享給我的圖片，分享所有版本時列出每個版本
+func listSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	shares, err := queryShares(db, `SELECT s.id, m.account, s.imageName, s.version, s.permission, s.createdTime
+		FROM ImageShares s JOIN Members m ON m.mid = s.ownerMid WHERE s.granteeMid = @mid AND m.disabled = 0`, principal(r).UID, true)
+	if err != nil {
+		log.Printf("Error: unable to list shares: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	result := []SharedImage{}
+	seen := make(map[string]int)
+	images := make(map[string][]Image)
+	for _, s := range shares {
+		if _, ok := images[s.Owner]; !ok {
+			if images[s.Owner], err = listImages(db, s.Owner); err != nil {
+				log.Printf("Error: unable get image list: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		for _, img := range images[s.Owner] {
+			if img.Name != s.Name || (s.Version != 0 && img.Version != strconv.Itoa(s.Version)) {
+				continue
+			}
+			// 同一版本同時符合多筆分享時，只列一次並取較大的權限
+			if i, ok := seen[img.Link]; ok {
+				if allows(s.Permission, result[i].Permission) {
+					result[i].Permission = s.Permission
+				}
+				continue
+			}
+			seen[img.Link] = len(result)
+			result = append(result, SharedImage{Image: img, Owner: s.Owner, Permission: s.Permission})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// queryShares : 查詢結果的第二欄為對方帳號，peerIsOwner 時放在 Owner，否則放在 Account
+func queryShares(db *sql.DB, query string, mid int, peerIsOwner bool) ([]Share, error) {
+	rows, err := db.Query(query, sql.Named("mid", mid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var (
+			s       Share
+			peer    string
+			version sql.NullInt64
+		)
+		if err := rows.Scan(&s.ID, &peer, &s.Name, &version, &s.Permission, &s.Created); err != nil {
+			return nil, err
+		}
+		if peerIsOwner {
+			s.Owner = peer
+		} else {
+			s.Account = peer
+		}
+		s.Version = int(version.Int64)
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// revokeShare : 擁有者取消分享
+func revokeShare(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req ShareRevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	revoke := "DELETE FROM ImageShares WHERE id = @id AND ownerMid = @mid"
+	res, err := db.Exec(revoke, sql.Named("id", req.ID), sql.Named("mid", principal(r).UID))
+	if err != nil {
+		log.Printf("Error: unable to revoke share: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package cloudsql
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestShareImage(t *testing.T) {
+	store, _ := setupTest(t)
+	alice, bob := store.addMember("alice"), store.addMember("bob")
+	img := store.addImage("alice", "cat.jpg", "1")
+
+	share := func(permission string) Share {
+		t.Helper()
+		rec := callHandler(t, shareImage, alice, http.MethodPost, "/api/share", ShareRequest{Name: "cat.jpg", Account: "bob", Permission: permission})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("share status = %d: %s", rec.Code, rec.Body)
+		}
+		var s Share
+		if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	first := share(PermissionView)
+	if first.ID == 0 {
+		t.Fatal("first share returned no id")
+	}
+	canAccess := func(permission string) bool {
+		t.Helper()
+		ok, err := canAccessImage(getDB(), bob.account, bob.mid, img.Link, permission)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !canAccess(PermissionView) || canAccess(PermissionDownload) {
+		t.Error("view share should allow view only")
+	}
+
+	// 重複分享時更新同一筆紀錄的權限
+	if second := share(PermissionDownload); second.ID != first.ID || len(store.shares) != 1 {
+		t.Errorf("second share id = %d (%d shares), want %d", second.ID, len(store.shares), first.ID)
+	}
+	if !canAccess(PermissionDownload) {
+		t.Error("download share should allow download")
+	}
+
+	if rec := callHandler(t, shareImage, alice, http.MethodPost, "/api/share", ShareRequest{Name: "dog.jpg", Account: "bob", Permission: PermissionView}); rec.Code != http.StatusNotFound {
+		t.Errorf("share of a missing image status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestShareDeniedWhenOwnerDisabled(t *testing.T) {
+	store, _ := setupTest(t)
+	alice, bob := store.addMember("alice"), store.addMember("bob")
+	img := store.addImage("alice", "cat.jpg", "1")
+	if rec := callHandler(t, shareImage, alice, http.MethodPost, "/api/share", ShareRequest{Name: "cat.jpg", Account: "bob", Permission: PermissionDownload}); rec.Code != http.StatusOK {
+		t.Fatalf("share status = %d: %s", rec.Code, rec.Body)
+	}
+
+	alice.disabled = true
+	ok, err := canAccessImage(getDB(), bob.account, bob.mid, img.Link, PermissionView)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("grantee can access an image of a disabled owner")
+	}
+}
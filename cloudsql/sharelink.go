@@ -0,0 +1,289 @@
+package cloudsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+type ShareLinkRequest struct {
+	// Filename 為 /api/list 回傳的 link，指定單一版本
+	Filename       string `json:"filename"`
+	ExpiresInHours int    `json:"expiresInHours"`
+	Password       string `json:"password"`
+	MaxDownloads   int    `json:"maxDownloads"`
+}
+
+// ShareLink : 公開分享連結與存取統計，不含 Token
+type ShareLink struct {
+	ID           int        `json:"id"`
+	Filename     string     `json:"filename"`
+	Protected    bool       `json:"protected"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	LastAccessAt *time.Time `json:"lastAccessAt,omitempty"`
+	Revoked      bool       `json:"revoked"`
+	Created      time.Time  `json:"created"`
+}
+
+type ShareLinkCreateResponse struct {
+	ShareLink
+	// URL 只會在建立時回傳一次
+	URL string `json:"url"`
+}
+
+// isShareLink : 以分享連結下載時不需要 Access Token
+func isShareLink(r *http.Request) bool {
+	return r.URL.Path == "/api/download" && r.URL.Query().Get("link") != ""
+}
+
+// createShareLink : 為自己的圖片版本建立公開分享連結
+func createShareLink(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+	var req ShareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Filename == "" {
+		http.Error(w, "filename is required", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInHours < 0 || req.MaxDownloads < 0 {
+		http.Error(w, "expiresInHours and maxDownloads must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var owned int
+	downloadFile := "exec dbo.DownloadImage @account, @filename"
+	if err := db.QueryRow(downloadFile, sql.Named("account", p.Account), sql.Named("filename", req.Filename)).Scan(&owned); err != nil {
+		log.Printf("Error: unable to check image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if owned == 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	token, hash, err := cloudkey.NewShareLinkToken()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var passwordHash, passwordVersion sql.NullString
+	if req.Password != "" {
+		encoded, version, err := cloudkey.HashPassword(req.Password)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		passwordHash, passwordVersion = nullString(encoded), nullString(version)
+	}
+
+	link := ShareLink{
+		Filename:     req.Filename,
+		Protected:    req.Password != "",
+		MaxDownloads: req.MaxDownloads,
+		Created:      time.Now().UTC(),
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresInHours > 0 {
+		t := link.Created.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		expiresAt = sql.NullTime{Time: t, Valid: true}
+		link.ExpiresAt = &t
+	}
+
+	addLink := `INSERT INTO ShareLinks (ownerMid, tokenHash, filename, passwordHash, passwordKeyVersion, expiresAt, maxDownloads, createdTime)
+		OUTPUT inserted.id VALUES (@mid, @hash, @filename, @password, @version, @expiresAt, @maxDownloads, @created)`
+	err = db.QueryRow(addLink,
+		sql.Named("mid", p.UID),
+		sql.Named("hash", hash),
+		sql.Named("filename", req.Filename),
+		sql.Named("password", passwordHash),
+		sql.Named("version", passwordVersion),
+		sql.Named("expiresAt", expiresAt),
+		sql.Named("maxDownloads", sql.NullInt64{Int64: int64(req.MaxDownloads), Valid: req.MaxDownloads > 0}),
+		sql.Named("created", link.Created),
+	).Scan(&link.ID)
+	if err != nil {
+		log.Printf("Error: unable to create share link: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ShareLinkCreateResponse{
+		ShareLink: link,
+		URL:       fmt.Sprintf("%s/?link=%s", baseURL, url.QueryEscape(token)),
+	})
+}
+
+// listShareLinks : 列出自己建立的分享連結與存取統計
+func listShareLinks(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	listLinks := `SELECT id, filename, passwordHash, expiresAt, maxDownloads, downloads, lastAccessAt, revokedAt, createdTime
+		FROM ShareLinks WHERE ownerMid = @mid ORDER BY createdTime DESC`
+	rows, err := db.Query(listLinks, sql.Named("mid", principal(r).UID))
+	if err != nil {
+		log.Printf("Error: unable to list share links: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var (
+			l                                  ShareLink
+			password                           sql.NullString
+			maxDownloads                       sql.NullInt64
+			expiresAt, lastAccessAt, revokedAt sql.NullTime
+		)
+		if err := rows.Scan(&l.ID, &l.Filename, &password, &expiresAt, &maxDownloads, &l.Downloads, &lastAccessAt, &revokedAt, &l.Created); err != nil {
+			log.Printf("Error: unable to list share links: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		l.Protected = password.Valid
+		l.MaxDownloads = int(maxDownloads.Int64)
+		l.Revoked = revokedAt.Valid
+		if expiresAt.Valid {
+			l.ExpiresAt = &expiresAt.Time
+		}
+		if lastAccessAt.Valid {
+			l.LastAccessAt = &lastAccessAt.Time
+		}
+		links = append(links, l)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error: unable to list share links: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+// revokeShareLink : 撤銷分享連結，統計資料仍保留
+func revokeShareLink(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req ShareRevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	revoke := "UPDATE ShareLinks SET revokedAt = SYSUTCDATETIME() WHERE id = @id AND ownerMid = @mid AND revokedAt IS NULL"
+	res, err := db.Exec(revoke, sql.Named("id", req.ID), sql.Named("mid", principal(r).UID))
+	if err != nil {
+		log.Printf("Error: unable to revoke share link: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// downloadShareLink : 以分享連結下載。有密碼時需以 POST 表單送出 password，
+// 錯誤次數依連結與 IP 鎖定
+func downloadShareLink(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	hash := cloudkey.HashToken(r.URL.Query().Get("link"))
+
+	var (
+		id                        int
+		filename                  string
+		password, passwordVersion sql.NullString
+	)
+	findLink := `SELECT l.id, l.filename, l.passwordHash, l.passwordKeyVersion FROM ShareLinks l JOIN Members m ON m.mid = l.ownerMid
+		WHERE l.tokenHash = @hash AND l.revokedAt IS NULL AND m.disabled = 0
+		AND (l.expiresAt IS NULL OR l.expiresAt > SYSUTCDATETIME())
+		AND (l.maxDownloads IS NULL OR l.downloads < l.maxDownloads)`
+	err := db.QueryRow(findLink, sql.Named("hash", hash)).Scan(&id, &filename, &password, &passwordVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Link not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to find share link: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if password.Valid {
+		if ok := checkLinkPassword(w, r, id, password.String, passwordVersion.String); !ok {
+			return
+		}
+	}
+
+	// 以條件更新計數，同時下載時不會超過上限
+	useLink := `UPDATE ShareLinks SET downloads = downloads + 1, lastAccessAt = SYSUTCDATETIME()
+		WHERE id = @id AND revokedAt IS NULL AND (maxDownloads IS NULL OR downloads < maxDownloads)`
+	res, err := db.Exec(useLink, sql.Named("id", id))
+	if err != nil {
+		log.Printf("Error: unable to update share link: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Link not found or expired", http.StatusNotFound)
+		return
+	}
+
+	if err := serveObject(w, filename, downloadName(db, filename)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err.Error())
+	}
+}
+
+// checkLinkPassword : 驗證分享連結密碼，失敗時已回應錯誤
+func checkLinkPassword(w http.ResponseWriter, r *http.Request, id int, encoded, version string) bool {
+	keys := []string{cloudkey.ShareLinkKey(id), cloudkey.IPKey(clientIP(r))}
+	if loginLimiter != nil {
+		wait, err := loginLimiter.Check(r.Context(), keys...)
+		if err != nil {
+			log.Printf("Error: unable to check login attempts: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return false
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return false
+		}
+	}
+
+	given := r.PostFormValue("password")
+	if r.Method != http.MethodPost || given == "" {
+		cloudkey.Unauthorized(w, "password_required", "this link is password protected")
+		return false
+	}
+	ok, _, err := cloudkey.VerifyPassword(given, encoded, version)
+	if err != nil {
+		log.Printf("Error: unable to verify link password: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		if loginLimiter != nil {
+			if _, err := loginLimiter.Failure(r.Context(), keys...); err != nil {
+				log.Printf("Error: unable to record login failure: %v", err)
+			}
+		}
+		cloudkey.Unauthorized(w, "invalid_password", "invalid password")
+		return false
+	}
+	if loginLimiter != nil {
+		if err := loginLimiter.Unlock(r.Context(), cloudkey.ShareLinkKey(id)); err != nil {
+			log.Printf("Error: unable to reset login attempts: %v", err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package cloudsql
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+// stubServeObject : 以物件路徑作為下載內容，不連線到 Storage
+func stubServeObject(t *testing.T) {
+	t.Helper()
+	orig := serveObject
+	serveObject = func(w http.ResponseWriter, object, destFileName string) error {
+		w.Write([]byte(object))
+		return nil
+	}
+	t.Cleanup(func() { serveObject = orig })
+}
+
+// createLink : 建立分享連結並回傳網址中的 Token
+func createLink(t *testing.T, owner *fakeMember, req ShareLinkRequest) (int, string) {
+	t.Helper()
+	rec := callHandler(t, createShareLink, owner, http.MethodPost, "/api/links/create", req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create link status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp ShareLinkCreateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(resp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.ID, u.Query().Get("link")
+}
+
+// openLink : 不登入以分享連結下載，password 不為空時以 POST 表單送出
+func openLink(token, password string) *httptest.ResponseRecorder {
+	target := "/api/download?link=" + url.QueryEscape(token)
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if password != "" {
+		r = httptest.NewRequest(http.MethodPost, target, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rec := httptest.NewRecorder()
+	API(rec, r)
+	return rec
+}
+
+func TestShareLinkMaxDownloads(t *testing.T) {
+	store, _ := setupTest(t)
+	stubServeObject(t)
+	alice := store.addMember("alice")
+	img := store.addImage("alice", "cat.jpg", "1")
+
+	if rec := callHandler(t, createShareLink, alice, http.MethodPost, "/api/links/create", ShareLinkRequest{Filename: "bob/dog.jpg-1"}); rec.Code != http.StatusNotFound {
+		t.Errorf("link to another account's image status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	_, token := createLink(t, alice, ShareLinkRequest{Filename: img.Link, MaxDownloads: 2})
+	for i := 0; i < 2; i++ {
+		rec := openLink(token, "")
+		if rec.Code != http.StatusOK || rec.Body.String() != img.Link {
+			t.Fatalf("download %d = %d %q, want %q", i, rec.Code, rec.Body, img.Link)
+		}
+	}
+	if rec := openLink(token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("download past the limit status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := openLink("not-a-token", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown link status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestShareLinkExpiryAndRevoke(t *testing.T) {
+	store, _ := setupTest(t)
+	stubServeObject(t)
+	alice := store.addMember("alice")
+	img := store.addImage("alice", "cat.jpg", "1")
+
+	id, token := createLink(t, alice, ShareLinkRequest{Filename: img.Link, ExpiresInHours: 1})
+	if exp, ok := store.links[id].expiresAt.(time.Time); !ok || time.Until(exp) <= 0 || time.Until(exp) > time.Hour {
+		t.Fatalf("expiresAt = %v, want within an hour", store.links[id].expiresAt)
+	}
+	if rec := openLink(token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("download status = %d: %s", rec.Code, rec.Body)
+	}
+	store.links[id].expiresAt = time.Now().UTC().Add(-time.Minute)
+	if rec := openLink(token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expired link status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	id, token = createLink(t, alice, ShareLinkRequest{Filename: img.Link})
+	if rec := callHandler(t, revokeShareLink, alice, http.MethodPost, "/api/links/revoke", ShareRevokeRequest{ID: id}); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := openLink(token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("revoked link status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// 擁有者停用時連結失效
+	_, token = createLink(t, alice, ShareLinkRequest{Filename: img.Link})
+	alice.disabled = true
+	if rec := openLink(token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("link of a disabled owner status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestShareLinkPassword(t *testing.T) {
+	store, _ := setupTest(t)
+	stubServeObject(t)
+	loginLimiter = cloudkey.NewLoginLimiter(SQLAttemptStore{}, cloudkey.DefaultAccountPolicy, cloudkey.DefaultIPPolicy)
+	alice := store.addMember("alice")
+	img := store.addImage("alice", "cat.jpg", "1")
+
+	id, token := createLink(t, alice, ShareLinkRequest{Filename: img.Link, Password: "secret", MaxDownloads: 5})
+	if p, ok := store.links[id].password.(string); !ok || !strings.HasPrefix(p, "$argon2id") {
+		t.Fatalf("stored link password = %v, want an argon2id hash", store.links[id].password)
+	}
+
+	if rec := openLink(token, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("download without password status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := openLink(token, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("download with a wrong password status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if a := store.attempts[cloudkey.ShareLinkKey(id)]; a == nil || a.failures != 1 {
+		t.Errorf("link attempts = %+v, want 1 failure", a)
+	}
+	if store.links[id].downloads != 0 {
+		t.Error("failed attempts counted as downloads")
+	}
+
+	rec := openLink(token, "secret")
+	if rec.Code != http.StatusOK || rec.Body.String() != img.Link {
+		t.Fatalf("download with password = %d %q", rec.Code, rec.Body)
+	}
+	if store.attempts[cloudkey.ShareLinkKey(id)] != nil {
+		t.Error("link attempts were not reset after a correct password")
+	}
+	if store.links[id].downloads != 1 {
+		t.Errorf("downloads = %d, want 1", store.links[id].downloads)
+	}
+}
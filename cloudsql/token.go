@@ -0,0 +1,213 @@
+package cloudsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rellik24/image2cloud/cloudkey"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// issueTokens : 簽發 Access Token 與 Refresh Token，family 為空時開始新的輪替鏈。
+// 每次簽發都重新讀取會員的角色，帳號已停用時回傳 errAccountDisabled
+func issueTokens(db *sql.DB, mid int, family string) (LoginResponse, error) {
+	var (
+		account, username, role string
+		disabled                bool
+	)
+	findMember := "SELECT account, username, role, disabled FROM Members WHERE mid = @mid"
+	if err := db.QueryRow(findMember, sql.Named("mid", mid)).Scan(&account, &username, &role, &disabled); err != nil {
+		return LoginResponse{}, err
+	}
+	if disabled {
+		return LoginResponse{}, errAccountDisabled
+	}
+	accessToken, err := cloudkey.CreateToken(mid, account, username, role)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	refreshToken, hash, err := cloudkey.NewRefreshToken()
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	if family == "" {
+		if family, err = cloudkey.RandomToken(16); err != nil {
+			return LoginResponse{}, err
+		}
+	}
+
+	addToken := "INSERT INTO RefreshTokens (mid, family, tokenHash, expiresAt) VALUES (@mid, @family, @hash, @expiresAt)"
+	if _, err := db.Exec(addToken, sql.Named("mid", mid), sql.Named("family", family), sql.Named("hash", hash), sql.Named("expiresAt", time.Now().UTC().Add(cloudkey.RefreshTokenTTL))); err != nil {
+		return LoginResponse{}, err
+	}
+	return LoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(cloudkey.TokenTTL.Seconds()),
+	}, nil
+}
+
+// refreshToken : 以 Refresh Token 換發新的 Token，舊的 Refresh Token 隨即失效。
+// 已使用或已撤銷的 Refresh Token 再次出現時視為外洩，撤銷整個 family
+func refreshToken(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	// body 沒有 Refresh Token 時使用 cookie 模式
+	cookie := req.RefreshToken == ""
+	if cookie {
+		if err := cloudkey.CheckCSRF(r); err != nil {
+			cloudkey.Forbidden(w, "csrf_failed", err.Error())
+			return
+		}
+		req.RefreshToken = refreshCookie(r)
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "refreshToken is required", http.StatusBadRequest)
+		return
+	}
+	hash := cloudkey.HashToken(req.RefreshToken)
+
+	var (
+		mid               int
+		family            string
+		expiresAt         time.Time
+		usedAt, revokedAt sql.NullTime
+	)
+	findToken := "SELECT mid, family, expiresAt, usedAt, revokedAt FROM RefreshTokens WHERE tokenHash = @hash"
+	err := db.QueryRow(findToken, sql.Named("hash", hash)).Scan(&mid, &family, &expiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		cloudkey.Unauthorized(w, "invalid_grant", "invalid refresh token")
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to find refresh token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if usedAt.Valid || revokedAt.Valid {
+		log.Printf("refresh token reuse detected for mid %d, revoking family", mid)
+		if err := revokeFamily(db, family); err != nil {
+			log.Println(err.Error())
+		}
+		cloudkey.Unauthorized(w, "invalid_grant", "invalid refresh token")
+		return
+	}
+	if time.Now().UTC().After(expiresAt) {
+		cloudkey.Unauthorized(w, "invalid_grant", "refresh token expired")
+		return
+	}
+
+	// 以條件更新避免同一個 Token 被同時使用兩次
+	useToken := "UPDATE RefreshTokens SET usedAt = SYSUTCDATETIME() WHERE tokenHash = @hash AND usedAt IS NULL AND revokedAt IS NULL"
+	res, err := db.Exec(useToken, sql.Named("hash", hash))
+	if err != nil {
+		log.Printf("Error: unable to use refresh token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		revokeFamily(db, family)
+		cloudkey.Unauthorized(w, "invalid_grant", "invalid refresh token")
+		return
+	}
+
+	resp, err := issueTokens(db, mid, family)
+	if errors.Is(err, errAccountDisabled) {
+		cloudkey.Unauthorized(w, "invalid_grant", "account disabled")
+		return
+	}
+	if err != nil {
+		log.Printf("Error: unable to issue token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := writeTokens(w, resp, cookie); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// logout : 撤銷目前的 Access Token 與 Refresh Token 所屬的 family
+func logout(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	p := principal(r)
+
+	var req RefreshRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.RefreshToken == "" {
+		req.RefreshToken = refreshCookie(r)
+	}
+	clearSessionCookies(w)
+	if req.RefreshToken != "" {
+		var family string
+		findFamily := "SELECT family FROM RefreshTokens WHERE tokenHash = @hash AND mid = @mid"
+		err := db.QueryRow(findFamily, sql.Named("hash", cloudkey.HashToken(req.RefreshToken)), sql.Named("mid", p.UID)).Scan(&family)
+		if err == nil {
+			err = revokeFamily(db, family)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error: unable to revoke refresh token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := revokeAccessToken(db, p.TokenID, p.ExpiresAt); err != nil {
+		log.Printf("Error: unable to revoke access token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeFamily :
+func revokeFamily(db *sql.DB, family string) error {
+	revoke := "UPDATE RefreshTokens SET revokedAt = SYSUTCDATETIME() WHERE family = @family AND revokedAt IS NULL"
+	_, err := db.Exec(revoke, sql.Named("family", family))
+	return err
+}
+
+// revokeMemberTokens : 撤銷會員所有的 Refresh Token (登出所有裝置)
+func revokeMemberTokens(db *sql.DB, mid int) error {
+	revoke := "UPDATE RefreshTokens SET revokedAt = SYSUTCDATETIME() WHERE mid = @mid AND revokedAt IS NULL"
+	_, err := db.Exec(revoke, sql.Named("mid", mid))
+	return err
+}
+
+// revokeAccessToken : 記錄已撤銷的 jti，並清除已過期的紀錄
+func revokeAccessToken(db *sql.DB, jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return nil
+	}
+	cleanup := "DELETE FROM RevokedTokens WHERE expiresAt < SYSUTCDATETIME()"
+	if _, err := db.Exec(cleanup); err != nil {
+		return err
+	}
+	revoke := `IF NOT EXISTS (SELECT 1 FROM RevokedTokens WHERE jti = @jti)
+		INSERT INTO RevokedTokens (jti, expiresAt) VALUES (@jti, @expiresAt)`
+	_, err := db.Exec(revoke, sql.Named("jti", jti), sql.Named("expiresAt", expiresAt.UTC()))
+	return err
+}
+
+// TokenRevocation : 以 RevokedTokens 資料表實作 cloudkey.RevocationChecker
+type TokenRevocation struct{}
+
+// IsRevoked :
+func (TokenRevocation) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var count int
+	checkRevoked := "SELECT count(*) FROM RevokedTokens WHERE jti = @jti"
+	if err := getDB().QueryRowContext(ctx, checkRevoked, sql.Named("jti", jti)).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,455 @@
+package cloudsql
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/rellik24/image2cloud/cloudimage"
+	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudstorage"
+)
+
+// maxUploadBytes 單一檔案的上限，maxUploadRequestBytes 一次上傳 (多個檔案或 zip) 的上限
+var (
+	maxUploadBytes        int64 = 20 << 20
+	maxUploadRequestBytes int64 = 100 << 20
+)
+
+const (
+	// maxBodyBytes 一般 JSON 請求的上限
+	maxBodyBytes = 1 << 20
+	// multipartOverhead multipart 的 boundary 與其他欄位
+	multipartOverhead = 1 << 20
+	// multipartMemory 超過時 multipart 的檔案改存於系統暫存目錄
+	multipartMemory = 32 << 20
+	// maxUploadFiles 一次上傳的檔案數 (含 zip 內的檔案)
+	maxUploadFiles = 50
+	// uploadWorkers 同一個請求中同時處理的檔案數
+	uploadWorkers = 4
+)
+
+// SetMaxUploadSize : 設定單一檔案與一次上傳的上限
+func SetMaxUploadSize(file, request int64) {
+	maxUploadBytes = file
+	maxUploadRequestBytes = request
+}
+
+// bodyLimit : 依 API 決定請求內容的上限
+func bodyLimit(r *http.Request) int64 {
+	if r.URL.Path == "/api/upload" {
+		return maxUploadRequestBytes + multipartOverhead
+	}
+	return maxBodyBytes
+}
+
+// limitBody : 超過上限時直接回傳 413，否則限制之後讀取的長度
+func limitBody(w http.ResponseWriter, r *http.Request) bool {
+	limit := bodyLimit(r)
+	if r.ContentLength > limit {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// bodyTooLarge : 讀取內容時超過 limitBody 的上限
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// UploadResult : 每個檔案的上傳結果，Status 為該檔案的 HTTP 狀態碼
+type UploadResult struct {
+	Name string `json:"name"`
+	// Archive 從 zip 解開的檔案所屬的壓縮檔
+	Archive string `json:"archive,omitempty"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+// uploadError : 單一檔案失敗的原因與狀態碼
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+var (
+	errFileTooLarge   = &uploadError{http.StatusRequestEntityTooLarge, "file too large"}
+	errTooManyFiles   = &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("too many files, at most %d per upload", maxUploadFiles)}
+	errInvalidArchive = &uploadError{http.StatusBadRequest, "invalid zip archive"}
+)
+
+// imageError : 將 cloudimage 的錯誤轉為對應的狀態碼
+func imageError(err error) error {
+	switch {
+	case errors.Is(err, cloudimage.ErrUnsupportedFormat):
+		return &uploadError{http.StatusUnsupportedMediaType, err.Error()}
+	case errors.Is(err, cloudimage.ErrInvalidImage), errors.Is(err, cloudimage.ErrTooManyPixels):
+		return &uploadError{http.StatusBadRequest, err.Error()}
+	case errors.Is(err, cloudimage.ErrTempFull):
+		return &uploadError{http.StatusServiceUnavailable, err.Error()}
+	}
+	return err
+}
+
+// formatExt : 檔名沒有副檔名時依圖片格式補上
+var formatExt = map[string]string{
+	"jpeg": "jpg",
+	"png":  "png",
+}
+
+// uploadSource : 檔案內容，驗證格式後需能回到開頭
+type uploadSource interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type memorySource struct {
+	*bytes.Reader
+}
+
+func (memorySource) Close() error {
+	return nil
+}
+
+// uploadItem : 待處理的單一檔案
+type uploadItem struct {
+	UploadResult
+	// filename 整理後的顯示名稱
+	filename string
+	size     int64
+	open     func() (uploadSource, error)
+}
+
+// setError : 依錯誤設定狀態碼，非預期的錯誤只寫入 log
+func (item *uploadItem) setError(err error) {
+	var uerr *uploadError
+	switch {
+	case err == nil:
+		item.Status = http.StatusOK
+	case errors.As(err, &uerr):
+		item.Status, item.Error = uerr.status, uerr.msg
+	case errors.Is(err, errQuotaExceeded):
+		item.Status, item.Error = http.StatusRequestEntityTooLarge, err.Error()
+	default:
+		log.Printf("Error: unable to upload %s: %v", item.Name, err)
+		item.Status, item.Error = http.StatusInternalServerError, "internal error"
+	}
+}
+
+// uploadImages : 上傳一或多個 file 欄位，zip 檔會解開後逐一處理，每個檔案各自計算版本。
+// 全部成功回傳 200，部分失敗回傳 207，全部失敗時回傳第一個錯誤的狀態碼
+func uploadImages(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	release, ok := limitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Println(err.Error())
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	items, err := uploadItems(headers)
+	if err != nil {
+		log.Printf("Error: unable to read upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// 每個請求使用獨立的暫存目錄，結束時一併刪除
+	ws, err := cloudimage.NewWorkspace()
+	if err != nil {
+		log.Printf("Error: unable to create workspace: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer ws.Close()
+
+	// 同名的檔案依序處理，避免取得相同的版本
+	locks := make(map[string]*sync.Mutex)
+	for _, item := range items {
+		if locks[item.filename] == nil {
+			locks[item.filename] = &sync.Mutex{}
+		}
+	}
+
+	p := principal(r)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, uploadWorkers)
+	for i := range items {
+		item := &items[i]
+		if item.Status != 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			lock := locks[item.filename]
+			lock.Lock()
+			defer lock.Unlock()
+			link, version, err := storeImage(r.Context(), db, ws, p, item)
+			item.setError(err)
+			item.Link, item.Version = link, version
+		}()
+	}
+	wg.Wait()
+
+	results := make([]UploadResult, len(items))
+	succeeded := 0
+	for i, item := range items {
+		results[i] = item.UploadResult
+		if item.Status == http.StatusOK {
+			succeeded++
+		}
+	}
+	status := http.StatusOK
+	switch {
+	case succeeded == 0:
+		status = results[0].Status
+	case succeeded < len(results):
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// uploadItems : 列出所有要處理的檔案，zip 檔展開為其中的檔案。
+// 超過 maxUploadFiles 的檔案不處理，只回報一次錯誤
+func uploadItems(headers []*multipart.FileHeader) ([]uploadItem, error) {
+	var (
+		items    []uploadItem
+		accepted int
+		overflow bool
+	)
+	add := func(item uploadItem) {
+		if accepted >= maxUploadFiles {
+			if !overflow {
+				overflow = true
+				item.setError(errTooManyFiles)
+				items = append(items, item)
+			}
+			return
+		}
+		accepted++
+		name, err := uploadName(item.Name, item.Archive)
+		// 回應為 JSON，原始檔名需是合法的 UTF-8
+		item.Name = strings.ToValidUTF8(item.Name, "\uFFFD")
+		if err != nil {
+			item.setError(&uploadError{http.StatusBadRequest, err.Error()})
+		}
+		item.filename = name
+		items = append(items, item)
+	}
+
+	for _, fh := range headers {
+		fh := fh
+		archive, err := isZip(fh)
+		if err != nil {
+			return nil, err
+		}
+		if !archive {
+			add(uploadItem{
+				UploadResult: UploadResult{Name: fh.Filename},
+				size:         fh.Size,
+				open:         func() (uploadSource, error) { return fh.Open() },
+			})
+			continue
+		}
+		if err := zipItems(fh, add); err != nil {
+			item := uploadItem{UploadResult: UploadResult{Name: fh.Filename}}
+			item.setError(errInvalidArchive)
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// uploadName : 整理檔名作為顯示名稱。zip 中以其他編碼 (例如 Big5) 儲存的檔名
+// 不是 UTF-8，改以 "壓縮檔名-原始檔名的雜湊" 加上原本的副檔名，
+// 同一個壓縮檔重新上傳時成為新版本，不同壓縮檔的檔案不會混在一起
+func uploadName(name, archive string) (string, error) {
+	if utf8.ValidString(name) {
+		return cloudstorage.SanitizeName(name)
+	}
+	_, ext := cloudstorage.SplitExt(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	if !utf8.ValidString(ext) {
+		ext = ""
+	}
+	base, _ := cloudstorage.SplitExt(path.Base(strings.ReplaceAll(archive, "\\", "/")))
+	if !utf8.ValidString(base) || base == "" || base == "." {
+		base = "file"
+	}
+	sum := sha256.Sum256([]byte(name))
+	return cloudstorage.SanitizeName(fmt.Sprintf("%s-%x%s", base, sum[:4], ext))
+}
+
+// isZip : 以內容判斷是否為 zip 檔
+func isZip(fh *multipart.FileHeader) (bool, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return http.DetectContentType(head[:n]) == "application/zip", nil
+}
+
+// zipItems : 展開 zip 內的檔案，略過目錄與系統產生的檔案
+func zipItems(fh *multipart.FileHeader, add func(uploadItem)) error {
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, fh.Size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		zf := zf
+		if zf.FileInfo().IsDir() || strings.HasPrefix(zf.Name, "__MACOSX/") || strings.HasPrefix(path.Base(zf.Name), ".") {
+			continue
+		}
+		add(uploadItem{
+			UploadResult: UploadResult{Name: zf.Name, Archive: fh.Filename},
+			size:         int64(zf.UncompressedSize64),
+			open:         func() (uploadSource, error) { return openZipEntry(zf) },
+		})
+	}
+	return nil
+}
+
+// openZipEntry : 解壓縮到記憶體，以實際讀取的長度限制大小，不採信 zip 記錄的大小
+func openZipEntry(zf *zip.File) (uploadSource, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, errInvalidArchive
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxUploadBytes+1))
+	if err != nil {
+		return nil, errInvalidArchive
+	}
+	if int64(len(data)) > maxUploadBytes {
+		return nil, errFileTooLarge
+	}
+	return memorySource{bytes.NewReader(data)}, nil
+}
+
+// storeImage : 驗證後寫入暫存、上傳到 Storage 並記錄 DB，回傳物件路徑與版本
+func storeImage(ctx context.Context, db *sql.DB, ws *cloudimage.Workspace, p *cloudkey.Principal, item *uploadItem) (string, int, error) {
+	if item.size > maxUploadBytes {
+		return "", 0, errFileTooLarge
+	}
+	src, err := item.open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	// 寫入暫存或 Storage 之前檢查內容
+	format, err := cloudimage.Validate(src)
+	if err != nil {
+		return "", 0, imageError(err)
+	}
+
+	// 寫入之前先預留使用量，上傳失敗時歸還
+	if err := reserveUsage(ctx, db, p.UID, p.Account, item.size, 1); err != nil {
+		return "", 0, err
+	}
+	uploaded := false
+	defer func() {
+		if !uploaded {
+			if err := releaseUsage(context.Background(), db, p.UID, item.size, 1); err != nil {
+				log.Printf("Error: unable to release usage: %v", err)
+			}
+		}
+	}()
+	if err := ws.Reserve(item.size); err != nil {
+		return "", 0, imageError(err)
+	}
+
+	// 儲存檔案
+	var version int
+	checkVersion := "select count(*)+1 from images i , members m where m.account = @account and i.Name = @filename and i.mid = m.mid"
+	if err := db.QueryRowContext(ctx, checkVersion, sql.Named("account", p.Account), sql.Named("filename", item.filename)).Scan(&version); err != nil {
+		return "", 0, err
+	}
+	linkName := cloudstorage.ObjectName(item.filename, version, formatExt[format])
+	out, err := ws.Create(linkName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer out.Close()
+
+	written, err := io.Copy(out, src)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	fileSize := float64(written) / 1024.0 / 1024.0
+	var sizeUnit string
+	if fileSize < 1.0 {
+		fileSize *= 1024.0
+		sizeUnit = "KB"
+	} else {
+		sizeUnit = "MB"
+	}
+	fileSizeStr := fmt.Sprintf("%.2f", fileSize)
+
+	// 上傳
+	if err := cloudstorage.UploadFile(p.Account, linkName, out.Name()); err != nil {
+		return "", 0, err
+	}
+	// 物件已寫入 Storage，之後的錯誤也保留使用量
+	uploaded = true
+
+	// 上傳成功記錄 DB
+	uploadFile := "exec dbo.InsertImage @account, @filename, @fileSize, @sizeUnit, @linkname, @version"
+	if _, err := db.ExecContext(ctx, uploadFile, sql.Named("account", p.Account), sql.Named("filename", item.filename), sql.Named("fileSize", fileSizeStr), sql.Named("sizeUnit", sizeUnit), sql.Named("linkName", linkName), sql.Named("version", version)); err != nil {
+		return "", 0, err
+	}
+	return cloudstorage.ObjectKey(p.Account, linkName), version, nil
+}
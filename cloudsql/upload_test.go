@@ -0,0 +1,95 @@
+package cloudsql
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unicode/utf8"
+)
+
+// multipartFiles : 建立含有指定檔案的 multipart 請求並解析
+func multipartFiles(t *testing.T, files map[string][]byte) []*multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, data := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	return r.MultipartForm.File["file"]
+}
+
+// rawNameHash : uploadName 使用的原始檔名雜湊
+func rawNameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:4])
+}
+
+func TestUploadItemsNonUTF8ZipNames(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	// Big5 編碼的 "照片.jpg" 與 "圖.png"，以及沒有副檔名的名稱，都不會讓整個請求失敗
+	for _, name := range []string{"\xb7\xd3\xa4\xf9.jpg", "dir/\xb9\xcf.png", "\xff\xfe", "ok.jpg"} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, NonUTF8: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("data"))
+	}
+	zw.Close()
+
+	items, err := uploadItems(multipartFiles(t, map[string][]byte{"photos.zip": archive.Bytes()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 顯示名稱包含壓縮檔名與原始檔名的雜湊
+	want := []string{"photos-" + rawNameHash("\xb7\xd3\xa4\xf9.jpg") + ".jpg", "photos-" + rawNameHash("dir/\xb9\xcf.png") + ".png", "photos-" + rawNameHash("\xff\xfe"), "ok.jpg"}
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(items), len(want))
+	}
+	for i, filename := range want {
+		item := items[i]
+		if item.filename != filename || item.Error != "" {
+			t.Errorf("item %d = %q (%s), want %q", i, item.filename, item.Error, filename)
+		}
+		if !utf8.ValidString(item.Name) || item.Archive != "photos.zip" {
+			t.Errorf("item %d Name = %q, Archive = %q", i, item.Name, item.Archive)
+		}
+	}
+}
+
+func TestUploadNameDependsOnArchive(t *testing.T) {
+	raw := "\xb7\xd3\xa4\xf9.jpg"
+	a, err := uploadName(raw, "trip.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := uploadName(raw, "party.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("entries of different archives share the display name %q", a)
+	}
+	if again, _ := uploadName(raw, "trip.zip"); again != a {
+		t.Errorf("re-uploading the archive gives %q, want %q", again, a)
+	}
+	if other, _ := uploadName("\xb9\xcf.jpg", "trip.zip"); other == a {
+		t.Errorf("different entries share the display name %q", a)
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"strings"
+	"path"
 	"time"
 
 	"cloud.google.com/go/storage"
 )
 
 // DownloadFile downloads an object to a file.
+// destFileName 為下載時的檔名，空白時使用物件名稱
 func DownloadFile(w http.ResponseWriter, object string, destFileName string) error {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
@@ -29,14 +31,59 @@ func DownloadFile(w http.ResponseWriter, object string, destFileName string) err
 	}
 	defer rc.Close()
 
+	if destFileName == "" {
+		destFileName = path.Base(object)
+	}
 	w.Header().Set("Content-Type", rc.Attrs.ContentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", destFileName, strings.Split(rc.Attrs.ContentType, "/")[1]))
+	w.Header().Set("Content-Disposition", ContentDisposition("attachment", destFileName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	if _, err := io.Copy(w, rc); err != nil {
 		return fmt.Errorf("io.Copy: %v", err)
 	}
+	return nil
+}
+
+// inlineTypes 可由瀏覽器直接顯示的格式，其他格式 (例如 HTML、SVG) 一律下載
+var inlineTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// inlineType : 物件的 Content-Type 是否可以 inline 顯示
+func inlineType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && inlineTypes[mediaType]
+}
+
+// ViewFile : JPEG 與 PNG 以 inline 方式回傳供瀏覽器直接顯示，其他格式改為下載。
+// 並以 CSP sandbox 避免物件內的指令碼在網站的 origin 下執行
+func ViewFile(w http.ResponseWriter, object string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+	defer cancel()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
 
-	fmt.Fprintf(w, "Blob %v downloaded to local file %v\n", object, destFileName)
+	rc, err := client.Bucket(bucketName).Object(object).NewReader(ctx)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return fmt.Errorf("Object(%q).NewReader: %v", object, err)
+	}
+	defer rc.Close()
 
+	w.Header().Set("Content-Type", rc.Attrs.ContentType)
+	if inlineType(rc.Attrs.ContentType) {
+		w.Header().Set("Content-Disposition", "inline")
+	} else {
+		w.Header().Set("Content-Disposition", ContentDisposition("attachment", path.Base(object)))
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, rc); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
 	return nil
 }
@@ -0,0 +1,21 @@
+package cloudstorage
+
+import "testing"
+
+func TestInlineType(t *testing.T) {
+	tests := map[string]bool{
+		"image/jpeg":                true,
+		"image/png":                 true,
+		"IMAGE/PNG":                 true,
+		"image/jpeg; charset=utf-8": true,
+		"image/svg+xml":             false,
+		"text/html":                 false,
+		"application/octet-stream":  false,
+		"":                          false,
+	}
+	for contentType, want := range tests {
+		if got := inlineType(contentType); got != want {
+			t.Errorf("inlineType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
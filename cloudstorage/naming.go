@@ -0,0 +1,174 @@
+package cloudstorage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// maxNameLength 顯示名稱的最大長度 (字元)
+	maxNameLength = 200
+	// maxObjectBase 物件名稱 (不含版本與副檔名) 的最大長度
+	maxObjectBase = 100
+	// objectHashBytes 物件名稱中顯示名稱雜湊的長度
+	objectHashBytes = 6
+	// maxAccountLength 帳號的最大長度，OIDC 帳號為 Email
+	maxAccountLength = 254
+)
+
+var (
+	ErrInvalidName    = errors.New("invalid file name")
+	ErrInvalidAccount = errors.New("invalid account")
+)
+
+// SanitizeName : 整理使用者上傳的檔名作為顯示名稱。
+// 去除路徑與控制字元並以 NFC 正規化，保留多個 "." 與 Unicode
+func SanitizeName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidName
+	}
+	// 部分瀏覽器會送出 Windows 路徑
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" || name == "/" || strings.Trim(name, ".") == "" {
+		return "", ErrInvalidName
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		base, ext := SplitExt(name)
+		keep := maxNameLength - utf8.RuneCountInString(ext)
+		if keep <= 0 {
+			return "", ErrInvalidName
+		}
+		base = string([]rune(base)[:keep])
+		name = base + ext
+	}
+	return name, nil
+}
+
+// SplitExt : 以最後一個 "." 分開名稱與副檔名 (含 ".")，"." 開頭的名稱視為沒有副檔名
+func SplitExt(name string) (base, ext string) {
+	i := strings.LastIndex(name, ".")
+	if i <= 0 || i == len(name)-1 {
+		return name, ""
+	}
+	return name[:i], name[i:]
+}
+
+// ObjectName : 由顯示名稱產生版本物件名稱 "base_hash_vN.ext"，只包含 [A-Za-z0-9._-]。
+// 轉成 ASCII 後不同的顯示名稱可能相同 (例如非拉丁文字或 "a b" 與 "a_b")，
+// 版本又是依顯示名稱計算，因此加上顯示名稱的雜湊避免覆蓋其他圖片。
+// 沒有副檔名時使用 defaultExt (例如圖片格式)
+func ObjectName(name string, version int, defaultExt string) string {
+	sum := sha256.Sum256([]byte(name))
+	base, ext := SplitExt(name)
+	base = safeASCII(base, maxObjectBase)
+	if base == "" {
+		base = "image"
+	}
+	base += "_" + hex.EncodeToString(sum[:objectHashBytes])
+	ext = strings.ToLower(safeASCII(strings.TrimPrefix(ext, "."), 10))
+	if ext == "" {
+		ext = defaultExt
+	}
+	if ext == "" {
+		return fmt.Sprintf("%s_v%d", base, version)
+	}
+	return fmt.Sprintf("%s_v%d.%s", base, version, ext)
+}
+
+// ValidAccount : 新建立的帳號 (註冊與 OIDC) 只允許 [A-Za-z0-9._@+-]，
+// 不可以 "." 開頭或包含 ".."。既有帳號可能不符合，Storage 只以 validPrefix 檢查
+func ValidAccount(account string) bool {
+	if account == "" || len(account) > maxAccountLength || account[0] == '.' || strings.Contains(account, "..") {
+		return false
+	}
+	for i := 0; i < len(account); i++ {
+		c := account[i]
+		if !(('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("._@+-", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// validPrefix : 帳號作為物件路徑第一段時不可包含 "/" 或為 "."、".."，
+// 避免改變路徑或前綴比對到其他帳號
+func validPrefix(account string) bool {
+	return account != "" && account != "." && account != ".." && !strings.ContainsAny(account, "/\\")
+}
+
+// ObjectKey : Bucket 中的物件路徑 "account/object"
+func ObjectKey(account, object string) string {
+	return account + "/" + object
+}
+
+// safeASCII : 將其他字元換成 "_"，去除重複與開頭結尾的 "_" 及 "."
+func safeASCII(s string, max int) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.'):
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// 去除重音符號，"é" 變成 "e"
+		default:
+			if !strings.HasSuffix(b.String(), "_") {
+				b.WriteByte('_')
+			}
+		}
+	}
+	out := strings.Trim(b.String(), "_.")
+	if len(out) > max {
+		out = strings.TrimRight(out[:max], "_.")
+	}
+	return out
+}
+
+// ContentDisposition : 依 RFC 6266 產生 header，filename 為 ASCII 替代名稱，
+// filename* 以 RFC 5987 編碼保留原始名稱
+func ContentDisposition(disposition, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			return -1
+		case r < 0x20 || r >= 0x7f || r == '"' || r == '\\' || r == '%':
+			return '_'
+		}
+		return r
+	}, norm.NFKD.String(filename))
+	v := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback)
+	if fallback != filename {
+		v += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return v
+}
+
+// encodeRFC5987 : attr-char 之外的位元組以 %XX 編碼
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < utf8.RuneSelf && (('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,139 @@
+package cloudstorage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "photo.jpg", want: "photo.jpg"},
+		{name: `C:\Users\me\照片.jpg`, want: "照片.jpg"},
+		{name: "../../etc/passwd", want: "passwd"},
+		{name: "archive.tar.gz", want: "archive.tar.gz"},
+		{name: "  spaced.png  ", want: "spaced.png"},
+		{name: "bad\x00\u200bname.png", want: "badname.png"},
+		// NFD 的 "é" 正規化為 NFC
+		{name: "cafe\u0301.png", want: "caf\u00e9.png"},
+		{name: "trailing. . ", want: "trailing"},
+		{name: "", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "dir/", want: "dir"},
+		{name: "\xff\xfe.jpg", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SanitizeName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	long, err := SanitizeName(strings.Repeat("長", 300) + ".jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len([]rune(long)); n != maxNameLength || !strings.HasSuffix(long, ".jpeg") {
+		t.Errorf("long name has %d runes (%q...), want %d ending in .jpeg", n, string([]rune(long)[:5]), maxNameLength)
+	}
+}
+
+func TestObjectName(t *testing.T) {
+	valid := regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	tests := []struct {
+		name       string
+		version    int
+		defaultExt string
+		prefix     string
+		suffix     string
+	}{
+		{name: "photo.jpg", version: 1, prefix: "photo_", suffix: "_v1.jpg"},
+		{name: "Résumé.PNG", version: 2, prefix: "Resume_", suffix: "_v2.png"},
+		{name: "照片.jpg", version: 1, prefix: "image_", suffix: "_v1.jpg"},
+		{name: "my photo.jpg", version: 3, prefix: "my_photo_", suffix: "_v3.jpg"},
+		{name: "noext", version: 1, defaultExt: "webp", prefix: "noext_", suffix: "_v1.webp"},
+		{name: ".hidden", version: 1, prefix: "hidden_", suffix: "_v1"},
+	}
+	for _, tt := range tests {
+		got := ObjectName(tt.name, tt.version, tt.defaultExt)
+		if !strings.HasPrefix(got, tt.prefix) || !strings.HasSuffix(got, tt.suffix) || !valid.MatchString(got) {
+			t.Errorf("ObjectName(%q, %d, %q) = %q, want %q...%q", tt.name, tt.version, tt.defaultExt, got, tt.prefix, tt.suffix)
+		}
+		if again := ObjectName(tt.name, tt.version, tt.defaultExt); again != got {
+			t.Errorf("ObjectName(%q) is not stable: %q != %q", tt.name, got, again)
+		}
+	}
+}
+
+// 轉成 ASCII 後相同的顯示名稱，同一版本也不能得到相同的物件名稱
+func TestObjectNameCollisions(t *testing.T) {
+	groups := [][]string{
+		{"照片.jpg", "圖片.jpg", "写真.jpg", "😀.jpg"},
+		{"my photo.jpg", "my_photo.jpg", "my  photo.jpg", "my/photo.jpg"},
+		{"cafe.png", "café.png", "cafe\u0301.png"},
+		{"photo.jpg", "photo.JPG", "photo.jpeg"},
+	}
+	for _, names := range groups {
+		seen := make(map[string]string)
+		for _, name := range names {
+			got := ObjectName(name, 1, "jpg")
+			if other, ok := seen[got]; ok {
+				t.Errorf("ObjectName(%q) = ObjectName(%q) = %q", name, other, got)
+			}
+			seen[got] = name
+		}
+	}
+}
+
+func TestValidAccount(t *testing.T) {
+	tests := map[string]bool{
+		"alice":                                 true,
+		"Alice_01":                              true,
+		"bob.smith@mail.tw":                     true,
+		"a+tag@x-y.com":                         true,
+		"":                                      false,
+		"a/b":                                   false,
+		"../alice":                              false,
+		"a..b":                                  false,
+		".hidden":                               false,
+		"with space":                            false,
+		"使用者":                                   false,
+		"a\\b":                                  false,
+		strings.Repeat("a", maxAccountLength+1): false,
+	}
+	for account, want := range tests {
+		if got := ValidAccount(account); got != want {
+			t.Errorf("ValidAccount(%q) = %v, want %v", account, got, want)
+		}
+	}
+}
+
+// 舊版註冊沒有限制帳號字元，Storage 只拒絕會改變路徑的帳號
+func TestValidPrefix(t *testing.T) {
+	tests := map[string]bool{
+		"alice":      true,
+		"with space": true,
+		"使用者":        true,
+		".hidden":    true,
+		"a..b":       true,
+		"":           false,
+		".":          false,
+		"..":         false,
+		"a/b":        false,
+		"../alice":   false,
+		`a\b`:        false,
+	}
+	for account, want := range tests {
+		if got := validPrefix(account); got != want {
+			t.Errorf("validPrefix(%q) = %v, want %v", account, got, want)
+		}
+	}
+}
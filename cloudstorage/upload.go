@@ -4,16 +4,18 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/rellik24/image2cloud/cloudimage"
 )
 
 // UploadFile: uploads an object.
-func UploadFile(w http.ResponseWriter, account, object string) error {
+// localPath 為 Workspace 中的暫存檔
+func UploadFile(account, object, localPath string) error {
+	if !validPrefix(account) {
+		return ErrInvalidAccount
+	}
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
@@ -22,7 +24,7 @@ func UploadFile(w http.ResponseWriter, account, object string) error {
 	defer client.Close()
 
 	// Open local file.
-	f, err := os.Open(fmt.Sprintf("%s%s", cloudimage.DirPath, object))
+	f, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("os.Open: %v", err)
 	}
@@ -31,7 +33,7 @@ func UploadFile(w http.ResponseWriter, account, object string) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
 	defer cancel()
 
-	o := client.Bucket(bucketName).Object(fmt.Sprintf("%s/%s", account, object))
+	o := client.Bucket(bucketName).Object(ObjectKey(account, object))
 
 	// Optional: set a generation-match precondition to avoid potential race
 	// conditions and data corruptions. The request to upload is aborted if the
@@ -54,6 +56,5 @@ func UploadFile(w http.ResponseWriter, account, object string) error {
 	if err := wc.Close(); err != nil {
 		return fmt.Errorf("Writer.Close: %v", err)
 	}
-	fmt.Fprintf(w, "Blob %v uploaded.\n", object)
 	return nil
 }
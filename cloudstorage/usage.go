@@ -0,0 +1,89 @@
+package cloudstorage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Usage : 帳號在 Bucket 中的使用量
+type Usage struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// AccountUsage : 計算單一帳號的使用量
+func AccountUsage(ctx context.Context, account string) (Usage, error) {
+	if !validPrefix(account) {
+		return Usage{}, ErrInvalidAccount
+	}
+	usage, err := listUsage(ctx, account+"/")
+	if err != nil {
+		return Usage{}, err
+	}
+	return usage[account], nil
+}
+
+// listUsage : 物件名稱為 "account/object"，依第一段路徑加總
+func listUsage(ctx context.Context, prefix string) (map[string]Usage, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	usage := make(map[string]Usage)
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket(%q).Objects: %v", bucketName, err)
+		}
+		account, _, ok := strings.Cut(attrs.Name, "/")
+		if !ok {
+			continue
+		}
+		u := usage[account]
+		u.Objects++
+		u.Bytes += attrs.Size
+		usage[account] = u
+	}
+	return usage, nil
+}
+
+// DeletePrefix : 刪除 "account/" 之下的所有物件，回傳刪除的數量。
+// prefix 必須是帳號加上 "/"，避免刪到名稱相同開頭的其他帳號
+func DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	if !strings.HasSuffix(prefix, "/") || !validPrefix(strings.TrimSuffix(prefix, "/")) {
+		return 0, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(bucketName)
+	deleted := 0
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("Bucket(%q).Objects: %v", bucketName, err)
+		}
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return deleted, fmt.Errorf("Object(%q).Delete: %v", attrs.Name, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,58 @@
+package cloudstorage
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// ZipEntry : 壓縮檔中的一個檔案
+type ZipEntry struct {
+	Object string
+	// Name 壓縮檔內的檔名，呼叫端需確保不重複
+	Name string
+}
+
+// ZipFiles : 依序讀取物件寫入 ZIP，不經過本機暫存。
+// 圖片已經過壓縮，以 Store 方式寫入以節省 CPU
+func ZipFiles(ctx context.Context, w io.Writer, entries []ZipEntry) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	zw := zip.NewWriter(w)
+	bucket := client.Bucket(bucketName)
+	for _, e := range entries {
+		if err := zipObject(ctx, zw, bucket, e); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// zipObject :
+func zipObject(ctx context.Context, zw *zip.Writer, bucket *storage.BucketHandle, e ZipEntry) error {
+	rc, err := bucket.Object(e.Object).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("Object(%q).NewReader: %v", e.Object, err)
+	}
+	defer rc.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     e.Name,
+		Method:   zip.Store,
+		Modified: rc.Attrs.LastModified,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
+	return nil
+}
@@ -5,10 +5,14 @@ go 1.19
 require (
 	cloud.google.com/go/cloudsqlconn v1.2.3
 	cloud.google.com/go/kms v1.10.1
+	cloud.google.com/go/secretmanager v1.10.0
 	cloud.google.com/go/storage v1.30.1
 	github.com/denisenkom/go-mssqldb v0.12.3
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	golang.org/x/crypto v0.6.0
+	golang.org/x/oauth2 v0.7.0
+	golang.org/x/text v0.9.0
 	google.golang.org/api v0.117.0
 )
 
@@ -27,11 +31,8 @@ require (
 	github.com/googleapis/enterprise-certificate-proxy v0.2.3 // indirect
 	github.com/googleapis/gax-go/v2 v2.8.0 // indirect
 	go.opencensus.io v0.24.0 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/net v0.9.0 // indirect
-	golang.org/x/oauth2 v0.7.0 // indirect
 	golang.org/x/sys v0.7.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
 	golang.org/x/time v0.3.0 // indirect
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
@@ -2,11 +2,17 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rellik24/image2cloud/cloudimage"
 	"github.com/rellik24/image2cloud/cloudkey"
+	"github.com/rellik24/image2cloud/cloudmail"
 	"github.com/rellik24/image2cloud/cloudsql"
 	"github.com/rellik24/image2cloud/cloudstorage"
 )
@@ -23,10 +29,20 @@ func main() {
 	log.Print("starting server...")
 
 	Init()
+	// 清除上次執行留下的暫存檔
+	if n, err := cloudimage.CleanTemp(); err != nil {
+		log.Printf("Error: unable to clean temporary files: %v", err)
+	} else if n > 0 {
+		log.Printf("removed %d stale temporary files", n)
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	})
 	http.HandleFunc("/api/", cloudsql.API)
+	http.HandleFunc("/.well-known/jwks.json", cloudkey.JWKSHandler)
+
+	// 繼續執行上次未完成的帳號刪除。刪除在背景執行，Cloud Run 需設定 CPU 一律分配 (--no-cpu-throttling)
+	go cloudsql.ResumeDeletions()
 
 	// Start HTTP server.
 	log.Printf("listening on port %s", port)
@@ -43,24 +59,163 @@ func Init() {
 		port = "8080"
 	}
 
-	project_id = os.Getenv("PROJECT_ID")
-	if project_id == "" {
-		log.Fatal("Can't get ENV variable: PROJECT_ID")
-	}
-	key_ring = os.Getenv("KEY_RING")
-	if key_ring == "" {
-		log.Fatal("Can't get ENV variable: KEY_RING")
-	}
-	key_name = os.Getenv("KEY_NAME")
-	if key_name == "" {
-		log.Fatal("Can't get ENV variable: KEY_NAME")
-	}
+	// 密碼 MAC: kms (預設) 或 local (開發與測試用，不需連線 GCP)。
+	// KEY_VERSION 為產生新 MAC 的金鑰版本；LEGACY_KEY_VERSION 為尚未記錄版本的舊資料
+	// 所使用的版本 (預設同 KEY_VERSION)。輪替時建立新版本並更新 KEY_VERSION，
+	// 舊版本需保持啟用，會員登入後即自動改用新版本。
 	key_version = os.Getenv("KEY_VERSION")
 	if key_version == "" {
 		log.Fatal("Can't get ENV variable: KEY_VERSION")
 	}
+	legacy_key_version := os.Getenv("LEGACY_KEY_VERSION")
+
+	switch mac_signer := os.Getenv("MAC_SIGNER"); mac_signer {
+	case "", "kms":
+		project_id = os.Getenv("PROJECT_ID")
+		if project_id == "" {
+			log.Fatal("Can't get ENV variable: PROJECT_ID")
+		}
+		key_ring = os.Getenv("KEY_RING")
+		if key_ring == "" {
+			log.Fatal("Can't get ENV variable: KEY_RING")
+		}
+		key_name = os.Getenv("KEY_NAME")
+		if key_name == "" {
+			log.Fatal("Can't get ENV variable: KEY_NAME")
+		}
+		cloudkey.SetMacSigner(cloudkey.NewKMSMacSigner(project_id, key_ring, key_name, key_version), legacy_key_version)
+	case "local":
+		mac_key_file := os.Getenv("MAC_KEY_FILE")
+		if mac_key_file == "" {
+			log.Fatal("Can't get ENV variable: MAC_KEY_FILE")
+		}
+		signer, err := cloudkey.NewLocalMacSigner(mac_key_file, key_version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cloudkey.SetMacSigner(signer, legacy_key_version)
+	default:
+		log.Fatalf("Unknown MAC_SIGNER: %s", mac_signer)
+	}
+
+	// 密碼雜湊是否以 MAC 作為 pepper (預設啟用)
+	cloudkey.SetPasswordHashing(cloudkey.DefaultPasswordParams, os.Getenv("PASSWORD_PEPPER") != "false")
+
+	// JWT 簽章金鑰: Secret Manager 資源名稱或本機檔案路徑
+	jwt_keys := os.Getenv("JWT_KEYS")
+	if jwt_keys == "" {
+		log.Fatal("Can't get ENV variable: JWT_KEYS")
+	}
+	if err := cloudkey.LoadKeySet(context.Background(), jwt_keys); err != nil {
+		log.Fatal(err)
+	}
+	go cloudkey.WatchKeySet(context.Background(), jwt_keys, 5*time.Minute)
+	cloudkey.SetRevocationChecker(cloudsql.TokenRevocation{})
+	cloudkey.SetAPIKeyResolver(cloudsql.APIKeyLookup{})
+
+	// Token 的 iss/aud，各環境需設定不同值
+	jwt_issuer := os.Getenv("JWT_ISSUER")
+	if jwt_issuer == "" {
+		jwt_issuer = "image2cloud"
+	}
+	jwt_audience := os.Getenv("JWT_AUDIENCE")
+	if jwt_audience == "" {
+		jwt_audience = "image2cloud"
+	}
+	cloudkey.SetValidation(jwt_issuer, jwt_audience, 30*time.Second)
 
-	cloudkey.SetHMAC(project_id, key_ring, key_name, key_version)
+	// 登入 Cookie 一律設定 Secure；本機以 http 開發時設定 INSECURE_COOKIES=true，正式環境不可開啟
+	cloudsql.SetInsecureCookies(os.Getenv("INSECURE_COOKIES") == "true")
+	// IP 鎖定使用的用戶端位址。TRUSTED_PROXY_HOPS 為請求固定經過的代理層數，
+	// 取 X-Forwarded-For 最後往前第 n 個位址: Cloud Run 設為 1 (Google 前端附加的位址)，
+	// 前面再經過外部負載平衡器時設為 2。未設定時改用 TRUSTED_PROXIES (以逗號分隔的 CIDR)，
+	// 只有來自這些位址的 X-Forwarded-For 會採用；兩者皆未設定時使用連線來源
+	if hops := os.Getenv("TRUSTED_PROXY_HOPS"); hops != "" {
+		n, err := strconv.Atoi(hops)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid TRUSTED_PROXY_HOPS: %s", hops)
+		}
+		cloudsql.SetProxyHops(n)
+	}
+	if err := cloudsql.SetTrustedProxies(strings.Split(os.Getenv("TRUSTED_PROXIES"), ",")); err != nil {
+		log.Fatal(err)
+	}
+	// 登入失敗追蹤: sql (預設，多個執行個體共用) 或 memory
+	switch login_limiter := os.Getenv("LOGIN_LIMITER"); login_limiter {
+	case "", "sql":
+		cloudsql.SetLoginLimiter(cloudkey.NewLoginLimiter(cloudsql.SQLAttemptStore{}, cloudkey.DefaultAccountPolicy, cloudkey.DefaultIPPolicy))
+	case "memory":
+		cloudsql.SetLoginLimiter(cloudkey.NewLoginLimiter(cloudkey.NewMemoryAttemptStore(), cloudkey.DefaultAccountPolicy, cloudkey.DefaultIPPolicy))
+	default:
+		log.Fatalf("Unknown LOGIN_LIMITER: %s", login_limiter)
+	}
+	// 上傳限制: sql (預設，多個執行個體共用) 或 memory
+	switch upload_limiter := os.Getenv("UPLOAD_LIMITER"); upload_limiter {
+	case "", "sql":
+		cloudsql.SetUploadLimiter(cloudkey.NewUploadLimiter(cloudsql.SQLBucketStore{}, cloudkey.DefaultAccountUploadPolicy, cloudkey.DefaultKeyUploadPolicy))
+	case "memory":
+		cloudsql.SetUploadLimiter(cloudkey.NewUploadLimiter(cloudkey.NewMemoryBucketStore(), cloudkey.DefaultAccountUploadPolicy, cloudkey.DefaultKeyUploadPolicy))
+	default:
+		log.Fatalf("Unknown UPLOAD_LIMITER: %s", upload_limiter)
+	}
+	// 重寄驗證信與忘記密碼的寄信限制: sql (預設，多個執行個體共用) 或 memory
+	switch mail_limiter := os.Getenv("MAIL_LIMITER"); mail_limiter {
+	case "", "sql":
+		cloudsql.SetMailLimiter(cloudkey.NewMailLimiter(cloudsql.SQLBucketStore{}, cloudkey.DefaultAccountMailPolicy, cloudkey.DefaultIPMailPolicy))
+	case "memory":
+		cloudsql.SetMailLimiter(cloudkey.NewMailLimiter(cloudkey.NewMemoryBucketStore(), cloudkey.DefaultAccountMailPolicy, cloudkey.DefaultIPMailPolicy))
+	default:
+		log.Fatalf("Unknown MAIL_LIMITER: %s", mail_limiter)
+	}
+	// 啟動時設為 admin 角色的帳號，以逗號分隔
+	cloudsql.SetAdmins(strings.Split(os.Getenv("ADMIN_ACCOUNTS"), ","))
+	// 每個帳號預設的儲存上限 (bytes / 圖片數量)，0 表示不限制，可由管理者個別調整
+	quota := cloudsql.Quota{Bytes: envInt("QUOTA_BYTES", 1<<30), Images: int(envInt("QUOTA_IMAGES", 1000))}
+	cloudsql.SetDefaultQuota(quota)
+	// 單一檔案與一次上傳 (多個檔案或 zip) 的上限，以及允許的最大像素數
+	cloudsql.SetMaxUploadSize(envInt("MAX_UPLOAD_BYTES", 20<<20), envInt("MAX_UPLOAD_REQUEST_BYTES", 100<<20))
+	cloudimage.MaxPixels = int(envInt("MAX_IMAGE_PIXELS", 40_000_000))
+	// 暫存檔合計的上限
+	cloudimage.MaxTempBytes = envInt("MAX_TEMP_BYTES", 1<<30)
+
+	// 郵件: smtp (預設) 或 capture。smtp 需設定 SMTP_HOST 與 MAIL_FROM
+	// (選用 SMTP_PORT、SMTP_USER、SMTP_PASS)，未設定時無法啟動。
+	// capture 不寄出郵件並將內容 (含驗證與重設密碼連結) 寫入 log，只能在本機開發時明確指定
+	mailer := os.Getenv("MAILER")
+	if mailer == "" {
+		mailer = "smtp"
+	}
+	switch mailer {
+	case "smtp":
+		smtp_host := os.Getenv("SMTP_HOST")
+		if smtp_host == "" {
+			log.Fatal("Can't get ENV variable: SMTP_HOST")
+		}
+		smtp_port := os.Getenv("SMTP_PORT")
+		if smtp_port == "" {
+			smtp_port = "587"
+		}
+		mail_from := os.Getenv("MAIL_FROM")
+		if mail_from == "" {
+			log.Fatal("Can't get ENV variable: MAIL_FROM")
+		}
+		cloudmail.Set(cloudmail.NewSMTPMailer(smtp_host, smtp_port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASS"), mail_from))
+	case "capture":
+		log.Print("Warning: MAILER=capture, emails are only written to the log")
+		cloudmail.Set(cloudmail.NewCaptureMailer())
+	default:
+		log.Fatalf("Unknown MAILER: %s", mailer)
+	}
+	// 郵件內連結使用的網址
+	if base_url := os.Getenv("BASE_URL"); base_url != "" {
+		cloudsql.SetBaseURL(base_url)
+	}
+	// 選用的 OpenID Connect 登入
+	if oidc_providers := os.Getenv("OIDC_PROVIDERS"); oidc_providers != "" {
+		if err := cloudkey.LoadOIDCProviders(oidc_providers); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	bucket_name := os.Getenv("BUCKET_NAME")
 	if bucket_name == "" {
@@ -68,3 +223,16 @@ func Init() {
 	}
 	cloudstorage.Set(bucket_name)
 }
+
+// envInt : 讀取數值的環境變數，未設定時使用預設值
+func envInt(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", name, v)
+	}
+	return n
+}